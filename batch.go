@@ -0,0 +1,164 @@
+package sqltocsv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchJob is one query for a Batch to export.
+type BatchJob struct {
+	Name      string // file name in the Batch's Dir, with .csv added
+	Query     string
+	Args      []interface{}
+	Configure func(c *Converter) // sets up the job's Converter (optional)
+	Timeout   time.Duration      // overrides the Batch Timeout for this job
+}
+
+// Batch runs a list of queries against DB, writing each to its own file
+// in Dir. Each file is written under a temporary name and renamed into
+// place once complete, so a file that exists is always a finished one.
+type Batch struct {
+	DB          *sql.DB
+	Dir         string
+	Jobs        []BatchJob
+	Concurrency int           // Jobs run at once (default is 4)
+	Timeout     time.Duration // limit on each job (default is no limit)
+}
+
+// BatchResult reports how one BatchJob went. A failed job has Err set and
+// leaves no file behind.
+type BatchResult struct {
+	Name     string
+	File     string
+	Rows     int64
+	Bytes    int64
+	SHA256   string // hex SHA-256 of the file
+	Duration time.Duration
+	Err      error
+}
+
+// Run runs every job, even when some fail, and returns a result for each
+// in the order of Jobs. Cancelling ctx stops jobs that are running and
+// fails those not yet started. If a job's Name isn't a plain file name,
+// or two jobs share one, no job is run and every result has the error.
+func (b Batch) Run(ctx context.Context) []BatchResult {
+	results := make([]BatchResult, len(b.Jobs))
+	if err := checkJobNames(b.Jobs); err != nil {
+		for i, job := range b.Jobs {
+			results[i] = BatchResult{Name: job.Name, Err: err}
+		}
+		return results
+	}
+
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, job := range b.Jobs {
+		wg.Add(1)
+		go func(i int, job BatchJob) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = b.run(ctx, job)
+		}(i, job)
+	}
+	wg.Wait()
+	return results
+}
+
+func (b Batch) run(ctx context.Context, job BatchJob) BatchResult {
+	started := time.Now()
+	result := BatchResult{
+		Name: job.Name,
+		File: filepath.Join(b.Dir, job.Name+".csv"),
+	}
+
+	if job.Timeout == 0 {
+		job.Timeout = b.Timeout
+	}
+	stats := &writeStats{}
+	result.Err = runJob(ctx, b.DB, job, func(converter *Converter) error {
+		return converter.writeFile(result.File, true, stats)
+	})
+
+	if result.Err != nil {
+		result.Err = fmt.Errorf("job %q: %w", job.Name, result.Err)
+	} else {
+		result.Rows = stats.rows
+		result.Bytes = stats.bytes
+		result.SHA256 = hex.EncodeToString(stats.sum.Sum(nil))
+	}
+	result.Duration = time.Since(started)
+	return result
+}
+
+// checkJobNames makes sure each job writes a file of its own in the
+// directory, even on a case-insensitive file system.
+func checkJobNames(jobs []BatchJob) error {
+	folded := map[string]string{}
+	for _, job := range jobs {
+		if err := checkFileName(job.Name); err != nil {
+			return fmt.Errorf("job %q: %w", job.Name, err)
+		}
+		if other, ok := folded[strings.ToLower(job.Name)]; ok {
+			return fmt.Errorf("jobs %q and %q would be written to the same file", other, job.Name)
+		}
+		folded[strings.ToLower(job.Name)] = job.Name
+	}
+	return nil
+}
+
+// checkFileName makes sure name can be used as a file name in a
+// directory, and won't land in another.
+func checkFileName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("the name is empty")
+	case name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("%q isn't a plain file name", name)
+	}
+	return nil
+}
+
+// queryer is what runJob queries, a *sql.DB or a *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// runJob runs job's query on db within its Timeout and hands write a
+// Converter for the rows.
+func runJob(ctx context.Context, db queryer, job BatchJob, write func(converter *Converter) error) error {
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, job.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, job.Query, job.Args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if err = ctx.Err(); err != nil {
+		return err // the query outlasted the timeout, for drivers that don't notice
+	}
+
+	converter := New(rows)
+	if job.Configure != nil {
+		job.Configure(converter)
+	}
+	return write(converter)
+}
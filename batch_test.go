@@ -0,0 +1,124 @@
+package sqltocsv_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestBatchRun(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|magicquery|op=string,millis=int64")
+	dir := t.TempDir()
+
+	batch := sqltocsv.Batch{
+		DB:          db,
+		Dir:         dir,
+		Concurrency: 2,
+		Jobs: []sqltocsv.BatchJob{
+			{Name: "people", Query: "SELECT|people|name,age|"},
+			{Name: "by_name", Query: "SELECT|people|name|name=?", Args: []interface{}{"Alice"},
+				Configure: func(c *sqltocsv.Converter) { c.WriteHeaders = false }},
+			{Name: "broken", Query: "SELECT|nope|name|"},
+			{Name: "slow", Query: "SELECT|magicquery|op|op=?,millis=?", Args: []interface{}{"sleep", int64(200)},
+				Timeout: 20 * time.Millisecond},
+		},
+	}
+	results := batch.Run(context.Background())
+
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+
+	people := results[0]
+	if people.Err != nil || people.Rows != 1 || people.Bytes != 17 || people.File != filepath.Join(dir, "people.csv") {
+		t.Errorf("unexpected result %+v", people)
+	}
+	actual, _ := os.ReadFile(people.File)
+	assertCsvMatch(t, "name,age\nAlice,1\n", string(actual))
+
+	actual, _ = os.ReadFile(results[1].File)
+	assertCsvMatch(t, "Alice\n", string(actual))
+
+	for _, failed := range results[2:] {
+		if failed.Err == nil {
+			t.Errorf("expected job %q to fail", failed.Name)
+		}
+		if _, err := os.Stat(failed.File); !os.IsNotExist(err) {
+			t.Errorf("expected no file for failed job %q", failed.Name)
+		}
+	}
+	if err := results[3].Err; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the slow job to time out, got %v", err)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(leftovers) > 0 {
+		t.Errorf("expected no temporary files left, found %v", leftovers)
+	}
+}
+
+func TestBatchFilesHaveWriteFilePermissions(t *testing.T) {
+	db := setupDatabase(t)
+	dir := t.TempDir()
+	if err := sqltocsv.WriteFile(filepath.Join(dir, "direct.csv"), queryRows(t, db, "SELECT|people|name|")); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := sqltocsv.Batch{DB: db, Dir: dir, Jobs: []sqltocsv.BatchJob{{Name: "staged", Query: "SELECT|people|name|"}}}
+	if results := batch.Run(context.Background()); results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+
+	direct, _ := os.Stat(filepath.Join(dir, "direct.csv"))
+	staged, _ := os.Stat(filepath.Join(dir, "staged.csv"))
+	if staged.Mode() != direct.Mode() {
+		t.Errorf("expected staged files to have mode %v like WriteFile's, got %v", direct.Mode(), staged.Mode())
+	}
+}
+
+func TestBatchRejectsJobNames(t *testing.T) {
+	db := setupDatabase(t)
+	for _, test := range []struct {
+		names    []string
+		expected string
+	}{
+		{[]string{"people", ""}, `job "": the name is empty`},
+		{[]string{"people", "../people"}, `"../people" isn't a plain file name`},
+		{[]string{"people", `sub\people`}, `isn't a plain file name`},
+		{[]string{"people", ".."}, `".." isn't a plain file name`},
+		{[]string{"people", "People"}, `jobs "people" and "People" would be written to the same file`},
+	} {
+		dir := t.TempDir()
+		batch := sqltocsv.Batch{DB: db, Dir: filepath.Join(dir, "out")}
+		os.Mkdir(batch.Dir, 0755)
+		for _, name := range test.names {
+			batch.Jobs = append(batch.Jobs, sqltocsv.BatchJob{Name: name, Query: "SELECT|people|name,age|"})
+		}
+
+		results := batch.Run(context.Background())
+		for _, result := range results {
+			if result.Err == nil || !strings.Contains(result.Err.Error(), test.expected) {
+				t.Errorf("%q: expected an error %s, got %v", test.names, test.expected, result.Err)
+			}
+		}
+		// nothing in Dir, nor next to it
+		if files, _ := os.ReadDir(batch.Dir); len(files) > 0 {
+			t.Errorf("%q: expected no jobs run, found %v", test.names, files)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 1 {
+			t.Errorf("%q: expected no jobs run, found %v", test.names, files)
+		}
+	}
+
+	snapshot := sqltocsv.Snapshot{DB: db, Dir: t.TempDir(), Jobs: []sqltocsv.BatchJob{{Name: "../people", Query: "SELECT|people|name,age|"}}}
+	if _, err := snapshot.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "isn't a plain file name") {
+		t.Errorf("expected the snapshot to reject the name, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// BinaryEncoding says how binary columns (BLOB, bytea, VARBINARY and
+// friends) are written to the CSV.
+type BinaryEncoding int
+
+const (
+	// BinaryRaw writes the bytes as they are (the default)
+	BinaryRaw BinaryEncoding = iota
+	// BinaryBase64 writes standard padded base64
+	BinaryBase64
+	// BinaryHex writes lower case hex
+	BinaryHex
+	// BinarySkip writes an empty cell
+	BinarySkip
+	// BinaryError refuses to convert a query with binary columns
+	BinaryError
+)
+
+type columnKind int
+
+const (
+	textColumn columnKind = iota
+	binaryColumn
+	uuidColumn
+)
+
+// columnKinds works out which columns hold binary data from the database
+// type names. Drivers that don't report types leave every column as text.
+func columnKinds(rows *sql.Rows) []columnKind {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+
+	kinds := make([]columnKind, len(columnTypes))
+	for i, columnType := range columnTypes {
+		kinds[i] = kindOf(columnType)
+	}
+	return kinds
+}
+
+func kindOf(columnType *sql.ColumnType) columnKind {
+	switch strings.ToUpper(columnType.DatabaseTypeName()) {
+	case "UUID", "UNIQUEIDENTIFIER":
+		return uuidColumn
+	case "BINARY":
+		if length, ok := columnType.Length(); ok && length == 16 {
+			return uuidColumn
+		}
+		return binaryColumn
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BYTEA",
+		"VARBINARY", "IMAGE", "RAW", "LONG RAW":
+		return binaryColumn
+	}
+	return textColumn
+}
+
+// formatBinary renders a []byte from a binary or UUID column. UUID columns
+// are only treated as binary when they hold exactly 16 bytes; drivers which
+// already hand back the text form get it passed through.
+func (c *Converter) formatBinary(value []byte, kind columnKind) string {
+	if kind == uuidColumn {
+		if len(value) == 16 {
+			return formatUUID(value)
+		}
+		return string(value)
+	}
+
+	switch c.BinaryEncoding {
+	case BinaryBase64:
+		return base64.StdEncoding.EncodeToString(value)
+	case BinaryHex:
+		return hex.EncodeToString(value)
+	case BinarySkip:
+		return ""
+	}
+	return string(value)
+}
+
+// checkBinaryColumns returns an error naming the first binary column when
+// BinaryEncoding is BinaryError.
+func (c *Converter) checkBinaryColumns(kinds []columnKind, columnNames []string) error {
+	if c.BinaryEncoding != BinaryError {
+		return nil
+	}
+	for i, kind := range kinds {
+		if kind == binaryColumn {
+			return fmt.Errorf("column %q is binary", columnNames[i])
+		}
+	}
+	return nil
+}
+
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
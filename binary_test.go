@@ -0,0 +1,97 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestBinaryEncodingRawByDefault(t *testing.T) {
+	converter := sqltocsv.New(getBinaryTestRows(t))
+
+	expected := "name,data,id,ref\nAlice,\x00\x01\xFE,\x01\x23\x45\x67\x89\xAB\xCD\xEF\x01\x23\x45\x67\x89\xAB\xCD\xEF,\"\x00\x11\x22\x22\x33\x44\x55\x66\x77\x88\x99\xAA\xBB\xCC\xDD\xEE\xFF\"\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestBinaryEncodingBase64(t *testing.T) {
+	converter := sqltocsv.New(getBinaryTestRows(t))
+
+	converter.BinaryEncoding = sqltocsv.BinaryBase64
+
+	expected := "name,data,id,ref\nAlice,AAH+,01234567-89ab-cdef-0123-456789abcdef,00112233-4455-6677-8899-aabbccddeeff\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestBinaryEncodingHex(t *testing.T) {
+	converter := sqltocsv.New(getBinaryTestRows(t))
+
+	converter.BinaryEncoding = sqltocsv.BinaryHex
+
+	expected := "name,data,id,ref\nAlice,0001fe,01234567-89ab-cdef-0123-456789abcdef,00112233-4455-6677-8899-aabbccddeeff\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestBinaryEncodingSkip(t *testing.T) {
+	converter := sqltocsv.New(getBinaryTestRows(t))
+
+	converter.BinaryEncoding = sqltocsv.BinarySkip
+
+	expected := "name,data,id,ref\nAlice,,01234567-89ab-cdef-0123-456789abcdef,00112233-4455-6677-8899-aabbccddeeff\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestBinaryEncodingError(t *testing.T) {
+	converter := sqltocsv.New(getBinaryTestRows(t))
+
+	converter.BinaryEncoding = sqltocsv.BinaryError
+
+	csv, err := converter.WriteString()
+	if err == nil {
+		t.Fatal("expected an error for a binary column")
+	}
+	if csv != "" {
+		t.Errorf("expected nothing written before the error, got %q", csv)
+	}
+}
+
+func TestBinaryEncodingTextUUIDPassesThrough(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|textuuids|id=uuid")
+	exec(t, db, "INSERT|textuuids|id=?", []byte("01234567-89ab-cdef-0123-456789abcdef"))
+
+	rows, err := db.Query("SELECT|textuuids|id|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	converter := sqltocsv.New(rows)
+	converter.BinaryEncoding = sqltocsv.BinaryHex
+
+	expected := "id\n01234567-89ab-cdef-0123-456789abcdef\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func getBinaryTestRows(t *testing.T) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|files|name=string,data=blob,id=uuid,ref=binary(16)")
+	exec(t, db, "INSERT|files|name=?,data=?,id=?,ref=?", "Alice",
+		[]byte{0x00, 0x01, 0xFE},
+		[]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF, 0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF},
+		[]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF})
+
+	rows, err := db.Query("SELECT|files|name,data,id,ref|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
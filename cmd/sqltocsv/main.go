@@ -0,0 +1,110 @@
+// Command sqltocsv works with files written by the sqltocsv package.
+//
+//	sqltocsv decrypt -passphrase-file pass.txt < report.csv.enc > report.csv
+//	sqltocsv decrypt -identity key.hex -in report.csv.enc -out report.csv
+//
+// An identity file holds a hex encoded X25519 private key.
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/sqltocsv"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "decrypt":
+		err = decrypt(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sqltocsv:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sqltocsv decrypt [-passphrase-file file | -identity file] [-in file] [-out file]")
+	os.Exit(2)
+}
+
+func decrypt(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase")
+	identityFile := flags.String("identity", "", "file holding a hex encoded X25519 private key")
+	in := flags.String("in", "", "encrypted input (default is stdin)")
+	out := flags.String("out", "", "decrypted output (default is stdout)")
+	flags.Parse(args)
+
+	var e sqltocsv.Encryption
+	switch {
+	case *passphraseFile != "":
+		passphrase, err := os.ReadFile(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		e.Passphrase = strings.TrimRight(string(passphrase), "\r\n")
+	case *identityFile != "":
+		encoded, err := os.ReadFile(*identityFile)
+		if err != nil {
+			return err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return fmt.Errorf("reading identity: %w", err)
+		}
+		if e.Identity, err = ecdh.X25519().NewPrivateKey(key); err != nil {
+			return fmt.Errorf("reading identity: %w", err)
+		}
+	default:
+		return errors.New("decrypt needs -passphrase-file or -identity")
+	}
+
+	input := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	plaintext, err := sqltocsv.NewDecryptReader(input, e)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = io.Copy(os.Stdout, plaintext)
+		return err
+	}
+	// write beside the destination and only rename once everything
+	// authenticated, so a tampered file never leaves plaintext behind
+	f, err := os.CreateTemp(filepath.Dir(*out), ".sqltocsv-decrypt-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, plaintext); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), *out)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestDecrypt(t *testing.T) {
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	passphraseFile := filepath.Join(dir, "pass.txt")
+	os.WriteFile(passphraseFile, []byte("correct horse\n"), 0600)
+	identityFile := filepath.Join(dir, "key.hex")
+	os.WriteFile(identityFile, []byte(hex.EncodeToString(identity.Bytes())+"\n"), 0600)
+
+	const csv = "name,age\nAlice,1\n"
+	for _, test := range []struct {
+		name string
+		e    sqltocsv.Encryption
+		key  []string
+	}{
+		{"passphrase", sqltocsv.Encryption{Passphrase: "correct horse"}, []string{"-passphrase-file", passphraseFile}},
+		{"identity", sqltocsv.Encryption{Recipient: identity.PublicKey()}, []string{"-identity", identityFile}},
+	} {
+		var encrypted bytes.Buffer
+		w, err := sqltocsv.NewEncryptWriter(&encrypted, test.e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(csv))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		in := filepath.Join(dir, test.name+".csv.enc")
+		os.WriteFile(in, encrypted.Bytes(), 0644)
+
+		out := filepath.Join(dir, test.name+".csv")
+		if err = decrypt(append(test.key, "-in", in, "-out", out)); err != nil {
+			t.Fatalf("%s: decrypt failed: %v", test.name, err)
+		}
+		if actual, _ := os.ReadFile(out); string(actual) != csv {
+			t.Errorf("%s: expected %q, got %q", test.name, csv, actual)
+		}
+
+		// a tampered file leaves no output behind
+		tampered := encrypted.Bytes()
+		tampered[len(tampered)-1] ^= 1
+		os.WriteFile(in, tampered, 0644)
+		os.Remove(out)
+		if err = decrypt(append(test.key, "-in", in, "-out", out)); err != sqltocsv.ErrDecrypt {
+			t.Errorf("%s: expected ErrDecrypt, got %v", test.name, err)
+		}
+		if _, err = os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no output for a tampered file", test.name)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package sqltocsv
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DuplicateColumnPolicy says what to do when a query returns more than one
+// column with the same name, like SELECT a.id, b.id.
+type DuplicateColumnPolicy int
+
+const (
+	// DuplicateAllow writes the columns with the same name (the default)
+	DuplicateAllow DuplicateColumnPolicy = iota
+	// DuplicateError refuses to convert the query
+	DuplicateError
+	// DuplicateSuffix keeps the first name and numbers the rest: id, id_2, id_3
+	DuplicateSuffix
+	// DuplicatePrefixTable names every duplicated column table.column using
+	// ColumnTables, falling back to DuplicateSuffix where that doesn't make
+	// the names unique or ColumnTables isn't set.
+	DuplicatePrefixTable
+)
+
+// resolveDuplicates returns columnNames with duplicates handled according
+// to the DuplicateColumns policy.
+func (c *Converter) resolveDuplicates(columnNames []string) ([]string, error) {
+	if len(c.ColumnTables) > 0 && len(c.ColumnTables) != len(columnNames) {
+		return nil, fmt.Errorf("%d ColumnTables given for %d columns", len(c.ColumnTables), len(columnNames))
+	}
+
+	counts := map[string]int{}
+	for _, name := range columnNames {
+		counts[name]++
+	}
+
+	if c.DuplicateColumns == DuplicateAllow {
+		return columnNames, nil
+	}
+
+	for _, name := range columnNames {
+		if counts[name] > 1 && c.DuplicateColumns == DuplicateError {
+			return nil, fmt.Errorf("query returns more than one column named %q", name)
+		}
+	}
+
+	resolved := append([]string(nil), columnNames...)
+	if c.DuplicateColumns == DuplicatePrefixTable && len(c.ColumnTables) > 0 {
+		for i, name := range columnNames {
+			if counts[name] > 1 && c.ColumnTables[i] != "" {
+				resolved[i] = c.ColumnTables[i] + "." + name
+			}
+		}
+	}
+
+	// number anything still duplicated, skipping names already taken
+	taken := map[string]bool{}
+	for _, name := range resolved {
+		taken[name] = true
+	}
+	seen := map[string]bool{}
+	for i, name := range resolved {
+		if !seen[name] {
+			seen[name] = true
+			continue
+		}
+		for n := 2; ; n++ {
+			candidate := name + "_" + strconv.Itoa(n)
+			if !taken[candidate] {
+				resolved[i] = candidate
+				taken[candidate] = true
+				seen[candidate] = true
+				break
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// columnSelection picks, orders and renames the columns that get written.
+// It is worked out once per Write from Columns and RenameColumns.
+type columnSelection struct {
+	indexes []int    // position in the full row of each selected column
+	names   []string // column names of the selection, as the query named them
+	headers []string // names after RenameColumns, used as the default headers
+	all     bool     // every column in its original order, so apply is a no-op
+	buf     []string // reused by apply
+}
+
+// selectColumns validates Columns and RenameColumns against the available
+// column names, which are the query's columns after any JSON flattening.
+func (c *Converter) selectColumns(available []string) (*columnSelection, error) {
+	position := map[string]int{}
+	duplicated := map[string]bool{}
+	for i, name := range available {
+		if _, ok := position[name]; ok {
+			duplicated[name] = true
+		}
+		position[name] = i
+	}
+
+	lookup := func(setting, name string) (int, error) {
+		i, ok := position[name]
+		if !ok {
+			return 0, fmt.Errorf("%s names column %q which is not in the query (have %v)", setting, name, available)
+		}
+		if duplicated[name] {
+			return 0, fmt.Errorf("%s names column %q which appears more than once in the query", setting, name)
+		}
+		return i, nil
+	}
+
+	selection := &columnSelection{all: len(c.Columns) == 0}
+	if selection.all {
+		for i, name := range available {
+			selection.indexes = append(selection.indexes, i)
+			selection.names = append(selection.names, name)
+		}
+	} else {
+		chosen := map[string]bool{}
+		for _, name := range c.Columns {
+			if chosen[name] {
+				return nil, fmt.Errorf("Columns names column %q more than once", name)
+			}
+			chosen[name] = true
+			i, err := lookup("Columns", name)
+			if err != nil {
+				return nil, err
+			}
+			selection.indexes = append(selection.indexes, i)
+			selection.names = append(selection.names, name)
+		}
+	}
+
+	for name := range c.RenameColumns {
+		if _, err := lookup("RenameColumns", name); err != nil {
+			return nil, err
+		}
+	}
+
+	// a rename mustn't collide with another header, but duplicates the
+	// query itself returned are left alone
+	written := map[string]bool{}
+	renamedTo := map[string]bool{}
+	for _, name := range selection.names {
+		header := name
+		renamed, ok := c.RenameColumns[name]
+		if ok {
+			header = renamed
+		}
+		if written[header] && (ok || renamedTo[header]) {
+			return nil, fmt.Errorf("RenameColumns would write more than one column with the header %q", header)
+		}
+		written[header] = true
+		renamedTo[header] = renamedTo[header] || ok
+		selection.headers = append(selection.headers, header)
+	}
+
+	return selection, nil
+}
+
+// keep returns a narrower selection with only the columns where keep is true.
+func (s *columnSelection) keep(keep []bool) *columnSelection {
+	narrowed := &columnSelection{all: s.all}
+	for i, ok := range keep {
+		if !ok {
+			narrowed.all = false
+			continue
+		}
+		narrowed.indexes = append(narrowed.indexes, s.indexes[i])
+		narrowed.names = append(narrowed.names, s.names[i])
+		narrowed.headers = append(narrowed.headers, s.headers[i])
+	}
+	return narrowed
+}
+
+// apply returns the selected columns of row in order. The returned row is
+// only valid until the next call.
+func (s *columnSelection) apply(row []string) []string {
+	if s.all {
+		return row
+	}
+	if s.buf == nil {
+		s.buf = make([]string, len(s.indexes))
+	}
+	for n, i := range s.indexes {
+		s.buf[n] = row[i]
+	}
+	return s.buf
+}
@@ -0,0 +1,193 @@
+package sqltocsv_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestColumnsSelectsAndReorders(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.Columns = []string{"bdate", "name"}
+
+	expected := "bdate,name\n1973-11-29 21:33:09 +0000 UTC,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestRenameColumns(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.Columns = []string{"age", "name"}
+	converter.RenameColumns = map[string]string{"name": "Name", "age": "Age"}
+
+	expected := "Age,Name\n1,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestRenameColumnsWithoutSelection(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.RenameColumns = map[string]string{"bdate": "Birthday"}
+
+	expected := "name,age,Birthday\nAlice,1,1973-11-29 21:33:09 +0000 UTC\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestColumnsProcessorSeesSelection(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.Columns = []string{"age", "name"}
+	converter.SetRowPreProcessor(func(row []string, columnNames []string) (bool, []string) {
+		return true, []string{strings.Join(columnNames, "+"), row[1]}
+	})
+
+	expected := "age,name\nage+name,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestColumnsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		rename  map[string]string
+		want    string
+	}{
+		{"unknown column", []string{"name", "shoe_size"}, nil, `"shoe_size"`},
+		{"duplicated column", []string{"name", "age", "name"}, nil, "more than once"},
+		{"unknown rename", nil, map[string]string{"nope": "x"}, `"nope"`},
+		{"colliding rename", nil, map[string]string{"age": "name"}, `header "name"`},
+	}
+
+	for _, test := range tests {
+		converter := getConverter(t)
+		converter.Columns = test.columns
+		converter.RenameColumns = test.rename
+
+		csv, err := converter.WriteString()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected error containing %s, got %v", test.name, test.want, err)
+		}
+		if csv != "" {
+			t.Errorf("%s: expected nothing written, got %q", test.name, csv)
+		}
+	}
+}
+
+func TestStrictWidthHeaders(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.StrictWidth = true
+	converter.Headers = []string{"Name", "Age"}
+
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for two headers over three columns")
+	}
+}
+
+func TestStrictWidthAfterProcessor(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.StrictWidth = true
+	converter.SetRowPreProcessor(func(row []string, columnNames []string) (bool, []string) {
+		return true, row[:2]
+	})
+
+	_, err := converter.WriteString()
+	if err == nil || !strings.Contains(err.Error(), "row 1 has 2 columns") {
+		t.Errorf("expected a row width error, got %v", err)
+	}
+}
+
+func TestStrictWidthProcessorWidensRows(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.StrictWidth = true
+	converter.Headers = []string{"name", "age", "bdate", "extra"}
+	converter.SetRowPreProcessor(func(row []string, columnNames []string) (bool, []string) {
+		return true, append(row, "x")
+	})
+
+	expected := "name,age,bdate,extra\nAlice,1,1973-11-29 21:33:09 +0000 UTC,x\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestDuplicateColumnsAllowedByDefault(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name|"))
+
+	expected := "name,age,name\nAlice,1,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestDuplicateColumnsError(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name|"))
+
+	converter.DuplicateColumns = sqltocsv.DuplicateError
+
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for the duplicated name column")
+	}
+}
+
+func TestDuplicateColumnsSuffix(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name,name|"))
+
+	converter.DuplicateColumns = sqltocsv.DuplicateSuffix
+	converter.Columns = []string{"name_3", "name"}
+
+	expected := "name_3,name\nAlice,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestDuplicateColumnsPrefixTable(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name|"))
+
+	converter.DuplicateColumns = sqltocsv.DuplicatePrefixTable
+	converter.ColumnTables = []string{"users", "users", "managers"}
+
+	expected := "users.name,age,managers.name\nAlice,1,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestDuplicateColumnsPrefixTableFallsBackToSuffix(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name|"))
+
+	converter.DuplicateColumns = sqltocsv.DuplicatePrefixTable
+
+	expected := "name,age,name_2\nAlice,1,Alice\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestDuplicateColumnsPrefixTableWrongLength(t *testing.T) {
+	converter := sqltocsv.New(getTestRowsByQuery(t, "SELECT|people|name,age,name|"))
+
+	converter.DuplicateColumns = sqltocsv.DuplicatePrefixTable
+	converter.ColumnTables = []string{"users", "managers"}
+
+	csv, err := converter.WriteString()
+	if err == nil || !strings.Contains(err.Error(), "2 ColumnTables given for 3 columns") {
+		t.Errorf("expected an error for the wrong number of ColumnTables, got %v", err)
+	}
+	if csv != "" {
+		t.Errorf("expected nothing written, got %q", csv)
+	}
+}
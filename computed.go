@@ -0,0 +1,56 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ComputedColumn is an extra column worked out for each row from an
+// expression over the query's columns, like price * qty or upper(country).
+//
+// Expressions are SQL-like: columns by name (in "double quotes" if they
+// need it), 'string' literals, numbers, TRUE, FALSE and NULL, the operators
+// + - * / % || = != <> < <= > >= AND OR NOT, and these functions:
+//
+//	strings:     upper lower trim length substr left right replace concat
+//	numbers:     abs round floor ceil
+//	dates:       year month day hour minute now date_add(t, days)
+//	             date_diff(a, b) in days, date_format(t, layout)
+//	             to_date(s[, layout]) with Go layouts like 2006-01-02
+//	conditional: if(condition, then, else) coalesce(a, b, ...)
+//	conversion:  string(x) number(x)
+//
+// Expressions are type checked against rows.ColumnTypes() before the first
+// row is written, so upper(price) is an error up front rather than halfway
+// through the file. Columns the driver doesn't report a type for are
+// checked as each row is read instead.
+type ComputedColumn struct {
+	Name       string
+	Expression string
+}
+
+// compileComputed compiles the ComputedColumns against the query's columns.
+func (c *Converter) compileComputed(rows *sql.Rows, columnNames []string) ([]expr, error) {
+	if len(c.ComputedColumns) == 0 {
+		return nil, nil
+	}
+	columns := exprColumns(rows, columnNames)
+	c.restrictExprColumns(columns)
+	computed := make([]expr, len(c.ComputedColumns))
+	for i, column := range c.ComputedColumns {
+		e, err := compileExpr(column.Expression, columns)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %q: %w", column.Name, err)
+		}
+		computed[i] = e
+	}
+	return computed, nil
+}
+
+func (c *Converter) computedColumnNames() []string {
+	names := make([]string, len(c.ComputedColumns))
+	for i, column := range c.ComputedColumns {
+		names[i] = column.Name
+	}
+	return names
+}
@@ -0,0 +1,138 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestComputedColumns(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{
+		{Name: "total", Expression: "price * qty"},
+		{Name: "country_code", Expression: "upper(coalesce(country, 'n/a'))"},
+		{Name: "size", Expression: "if(qty >= 10, 'bulk', 'single')"},
+		{Name: "placed_month", Expression: "date_format(placed, '2006-01')"},
+	}
+
+	expected := "item,price,qty,placed,country,total,country_code,size,placed_month\n" +
+		"widget,2.5,3,2020-01-15 09:30:00 +0000 UTC,nz,7.5,NZ,single,2020-01\n" +
+		"gadget,4,10,2021-06-01 00:00:00 +0000 UTC,,40,N/A,bulk,2021-06\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestComputedColumnsWorkWithColumns(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{
+		{Name: "label", Expression: `item || ' x' || string(qty)`},
+		{Name: "days", Expression: "date_diff(placed, to_date('2020-01-01'))"},
+		{Name: "year", Expression: "year(placed)"},
+	}
+	converter.Columns = []string{"label", "year", "days"}
+
+	expected := "label,year,days\n" +
+		"widget x3,2020,14.395833333333334\n" +
+		"gadget x10,2021,517\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestComputedColumnsStringFunctions(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{
+		{Name: "a", Expression: "substr(item, 2, 3)"},
+		{Name: "b", Expression: "left(item, 2) || right(item, 2)"},
+		{Name: "c", Expression: "length(replace(item, 'g', ''))"},
+		{Name: "d", Expression: "round(price / 3, 2)"},
+		{Name: "e", Expression: "-qty % 4"},
+		{Name: "f", Expression: "NOT (qty > 5 AND price < 3)"},
+	}
+	converter.Columns = []string{"a", "b", "c", "d", "e", "f"}
+
+	expected := "a,b,c,d,e,f\n" +
+		"idg,wiet,5,0.83,-3,true\n" +
+		"adg,gaet,4,1.33,-2,true\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestComputedColumnsFunctionEdgeCases(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{
+		{Name: "a", Expression: "round(qty, -1)"},
+		{Name: "b", Expression: "round(qty * 7, -1)"},
+		{Name: "c", Expression: "substr(item, 2, 9223372036854775807)"},
+	}
+	converter.Columns = []string{"a", "b", "c"}
+
+	expected := "a,b,c\n" +
+		"0,20,idget\n" +
+		"10,70,adget\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestComputedColumnsCompileErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"upper(price)", "argument 1 of upper() must be a string, got number"},
+		{"item * 2", "* needs numbers, got string"},
+		{"nope + 1", `unknown column "nope"`},
+		{"frobnicate(item)", "unknown function frobnicate()"},
+		{"if(qty, 1, 2)", "must be a boolean"},
+		{"if(qty > 1, 'a', 2)", "mix string and number"},
+		{"price * (qty", `expected ")"`},
+		{"'unterminated", "unterminated"},
+	}
+
+	for _, test := range tests {
+		converter := sqltocsv.New(getOrderTestRows(t))
+		converter.ComputedColumns = []sqltocsv.ComputedColumn{{Name: "x", Expression: test.expression}}
+
+		csv, err := converter.WriteString()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected error containing %q, got %v", test.expression, test.want, err)
+		}
+		if csv != "" {
+			t.Errorf("%s: expected nothing written, got %q", test.expression, csv)
+		}
+	}
+}
+
+func TestComputedColumnsRuntimeError(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{{Name: "x", Expression: "qty / (qty - 3)"}}
+
+	_, err := converter.WriteString()
+	if err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("expected a division by zero error, got %v", err)
+	}
+}
+
+func getOrderTestRows(t *testing.T) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|orders|item=string,price=float64,qty=int32,placed=datetime,country=nullstring")
+	exec(t, db, "INSERT|orders|item=?,price=?,qty=?,placed=?,country=?", "widget", 2.5, 3, time.Date(2020, 1, 15, 9, 30, 0, 0, time.UTC), "nz")
+	exec(t, db, "INSERT|orders|item=?,price=?,qty=?,placed=?,country=?", "gadget", 4.0, 10, time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), nil)
+
+	rows, err := db.Query("SELECT|orders|item,price,qty,placed,country|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
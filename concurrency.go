@@ -0,0 +1,168 @@
+package sqltocsv
+
+import (
+	"sync"
+)
+
+// concurrentBatchSize is how many scanned rows are handed to a worker at
+// a time when Concurrency is set.
+const concurrentBatchSize = 256
+
+// rowBatch is a run of scanned rows on its way through a worker.
+type rowBatch struct {
+	values  [][]interface{}
+	scanErr error      // error from scanning the row after the last in values
+	rows    [][]string // finished rows, ready for the writer
+	err     error
+	done    chan struct{}
+}
+
+// writeConcurrently scans rows on one goroutine, formats batches of them
+// on Concurrency workers, and hands the finished rows to writeRow in the
+// order they were read. At most 2 * Concurrency batches are in flight at
+// once, which bounds the memory used.
+func (c Converter) writeConcurrently(scanner *rowScanner, pipeline *rowPipeline, writeRow func([]string) error) error {
+	workers := c.Concurrency
+	work := make(chan *rowBatch, workers)
+	ordered := make(chan *rowBatch, 2*workers)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(scanner *rowScanner, pipeline *rowPipeline) {
+			defer wg.Done()
+			for batch := range work {
+				batch.err = formatBatch(scanner, pipeline, batch)
+				close(batch.done)
+			}
+		}(scanner.clone(), pipeline.clone())
+	}
+
+	var readErr error
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		readErr = readBatches(scanner, work, ordered, stop)
+	}()
+
+	var err error
+	for batch := range ordered {
+		if err != nil {
+			continue // draining so the reader can finish
+		}
+		<-batch.done
+		for _, row := range batch.rows {
+			if err = writeRow(row); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = batch.err
+		}
+		if err != nil {
+			close(stop)
+		}
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = readErr
+	}
+	return err
+}
+
+// readBatches scans rows into batches, sending each to work and, in the
+// same order, to ordered. It is the only caller of rows.Next.
+func readBatches(scanner *rowScanner, work, ordered chan<- *rowBatch, stop <-chan struct{}) error {
+	rows := scanner.rows
+	for {
+		batch := &rowBatch{done: make(chan struct{})}
+		for len(batch.values) < concurrentBatchSize && rows.Next() {
+			// a fresh slice per row, as *interface{} scans copy driver owned bytes
+			values := make([]interface{}, len(scanner.columnNames))
+			valuePtrs := make([]interface{}, len(values))
+			for i := range values {
+				valuePtrs[i] = &values[i]
+			}
+			if batch.scanErr = rows.Scan(valuePtrs...); batch.scanErr != nil {
+				break
+			}
+			if scanner.c.onScan != nil {
+				var keep bool
+				if keep, batch.scanErr = scanner.c.onScan(values); batch.scanErr != nil {
+					break
+				} else if !keep {
+					continue
+				}
+			}
+			batch.values = append(batch.values, values)
+		}
+		if len(batch.values) == 0 && batch.scanErr == nil {
+			return rows.Err()
+		}
+
+		select {
+		case work <- batch:
+		case <-stop:
+			return nil
+		}
+		select {
+		case ordered <- batch:
+		case <-stop:
+			return nil
+		}
+		if batch.scanErr != nil {
+			return nil
+		}
+	}
+}
+
+// formatBatch runs each row of batch through the scanner's formatting and
+// the pipeline, keeping a copy of every finished row.
+func formatBatch(scanner *rowScanner, pipeline *rowPipeline, batch *rowBatch) error {
+	emit := func(row []string) error {
+		batch.rows = append(batch.rows, append([]string(nil), row...))
+		return nil
+	}
+	for _, values := range batch.values {
+		scanner.values = values
+		row, err := scanner.format()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			continue
+		}
+		if err = pipeline.run(row, emit); err != nil {
+			return err
+		}
+	}
+	batch.values = nil
+	return batch.scanErr
+}
+
+// clone returns a scanner with its own scratch space, for a worker.
+func (s *rowScanner) clone() *rowScanner {
+	clone := *s
+	clone.rawSafe = make([]bool, len(s.columnNames))
+	clone.row = make([]string, len(s.columnNames), cap(s.row))
+	clone.buf = nil
+	return &clone
+}
+
+// clone returns a pipeline with its own scratch space, for a worker. The
+// masker and row processors are shared.
+func (p *rowPipeline) clone() *rowPipeline {
+	clone := *p
+	shape := *p.shape
+	if shape.single != nil {
+		shape.single = make([][]string, 1)
+	}
+	selection := *p.selection
+	selection.buf = nil
+	clone.shape = &shape
+	clone.selection = &selection
+	clone.single = make([][]string, 1)
+	return &clone
+}
@@ -0,0 +1,94 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestConcurrencyMatchesSequentialOutput(t *testing.T) {
+	db := setupEventsDatabase(t, 2000)
+
+	configure := func(converter *sqltocsv.Converter) {
+		converter.TimeFormat = time.RFC3339
+		converter.Filter = "count % 5 != 0"
+		converter.ComputedColumns = []sqltocsv.ComputedColumn{{Name: "double", Expression: "count * 2"}}
+		converter.MaskRules = []sqltocsv.MaskRule{{Column: "name", Method: sqltocsv.MaskHash}}
+		converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+			if strings.HasSuffix(row[1], "7") {
+				return [][]string{row, {"subtotal", row[1]}}
+			}
+			return [][]string{row}
+		})
+	}
+
+	sequential := sqltocsv.New(queryEvents(t, db))
+	configure(sequential)
+	expected, err := sequential.WriteString()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, concurrency := range []int{2, 4, 16} {
+		concurrent := sqltocsv.New(queryEvents(t, db))
+		configure(concurrent)
+		concurrent.Concurrency = concurrency
+
+		actual, err := concurrent.WriteString()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if actual != expected {
+			t.Errorf("output with Concurrency %d differs from sequential output", concurrency)
+		}
+	}
+}
+
+func TestConcurrencyStopsOnError(t *testing.T) {
+	db := setupEventsDatabase(t, 2000)
+
+	converter := sqltocsv.New(queryEvents(t, db))
+	converter.Concurrency = 4
+	converter.StrictWidth = true
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		if row[1] == "1500" {
+			return [][]string{append(row, "extra")}
+		}
+		return [][]string{row}
+	})
+
+	_, err := converter.WriteString()
+	if err == nil || !strings.Contains(err.Error(), "row 1501") {
+		t.Errorf("expected an error for row 1501, got %v", err)
+	}
+}
+
+func BenchmarkWriteConcurrency4(b *testing.B) {
+	db := setupEventsDatabase(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows, err := db.Query("SELECT|events|name,count,score,at,note|")
+		if err != nil {
+			b.Fatalf("error querying: %v", err)
+		}
+		converter := sqltocsv.New(rows)
+		converter.Concurrency = 4
+		if err = converter.Write(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func queryEvents(t *testing.T, db *sql.DB) *sql.Rows {
+	rows, err := db.Query("SELECT|events|name,count,score,at,note|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
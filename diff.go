@@ -0,0 +1,337 @@
+package sqltocsv
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DiffSource is one side of a Diff: query results or a CSV file with a
+// header row, like one written by WriteFile.
+type DiffSource struct {
+	Rows      *sql.Rows          // rows to compare, formatted as a Converter writes them
+	Configure func(c *Converter) // sets up the Converter for Rows (optional)
+
+	File      string // CSV file to compare, used when Rows is nil
+	Delimiter rune   // delimiter of File (default is comma)
+}
+
+// Diff compares two row sources by key and writes what changed from Old
+// to New as a CSV. Both sides are sorted by key before comparing, in
+// memory while they fit and through temporary files after that, so
+// neither needs to fit in memory.
+//
+// Values are compared as the text a Converter would write, so format
+// both sides the same way: 1 and 1.0 are different values.
+type Diff struct {
+	Old, New DiffSource
+	Keys     []string // columns that together identify a row
+
+	MemoryLimit int    // bytes of rows to hold per side before sorting on disk (default is 64MiB)
+	TempDir     string // where sorted runs go (default is os.TempDir())
+	Separator   string // between the names in changed_columns (default is ;)
+}
+
+// DiffCounts totals the changes a Diff found.
+type DiffCounts struct {
+	Added, Removed, Modified int64
+}
+
+// Write writes the changes as a CSV with a change column of added,
+// removed or modified, a changed_columns column listing the columns that
+// differ in modified rows, and then New's columns. Removed rows have
+// their old values. Unchanged rows aren't written. Both sides must have
+// the same columns, though not necessarily in the same order.
+func (d Diff) Write(w io.Writer) (DiffCounts, error) {
+	var counts DiffCounts
+	if len(d.Keys) == 0 {
+		return counts, errors.New("Diff needs Keys to match rows by")
+	}
+
+	newColumns, newRows, err := d.sort(d.New, nil)
+	if err != nil {
+		return counts, fmt.Errorf("new: %w", err)
+	}
+	defer newRows.Close()
+	_, oldRows, err := d.sort(d.Old, newColumns)
+	if err != nil {
+		return counts, fmt.Errorf("old: %w", err)
+	}
+	defer oldRows.Close()
+
+	keys, err := columnIndexes(newColumns, d.Keys)
+	if err != nil {
+		return counts, err
+	}
+	separator := d.Separator
+	if separator == "" {
+		separator = ";"
+	}
+
+	csvWriter := csv.NewWriter(w)
+	if err = csvWriter.Write(append([]string{"change", "changed_columns"}, newColumns...)); err != nil {
+		return counts, err
+	}
+	write := func(change, changed string, row []string) error {
+		return csvWriter.Write(append([]string{change, changed}, row...))
+	}
+
+	oldRow, oldErr := nextUnique(oldRows, keys, nil)
+	newRow, newErr := nextUnique(newRows, keys, nil)
+	for err == nil && (oldErr == nil || newErr == nil) {
+		order := 0
+		switch {
+		case oldErr != nil:
+			order = 1
+		case newErr != nil:
+			order = -1
+		default:
+			order = compareKeys(oldRow, newRow, keys)
+		}
+
+		switch {
+		case order < 0:
+			counts.Removed++
+			err = write("removed", "", oldRow)
+			oldRow, oldErr = nextUnique(oldRows, keys, oldRow)
+		case order > 0:
+			counts.Added++
+			err = write("added", "", newRow)
+			newRow, newErr = nextUnique(newRows, keys, newRow)
+		default:
+			var changed []string
+			for i := range newRow {
+				if oldRow[i] != newRow[i] {
+					changed = append(changed, newColumns[i])
+				}
+			}
+			if len(changed) > 0 {
+				counts.Modified++
+				err = write("modified", strings.Join(changed, separator), newRow)
+			}
+			oldRow, oldErr = nextUnique(oldRows, keys, oldRow)
+			newRow, newErr = nextUnique(newRows, keys, newRow)
+		}
+	}
+	if err != nil {
+		return counts, err
+	}
+	if oldErr != io.EOF {
+		return counts, fmt.Errorf("old: %w", oldErr)
+	}
+	if newErr != io.EOF {
+		return counts, fmt.Errorf("new: %w", newErr)
+	}
+	csvWriter.Flush()
+	return counts, csvWriter.Error()
+}
+
+// WriteFile writes the changes to a file, as Write does.
+func (d Diff) WriteFile(csvFileName string) (DiffCounts, error) {
+	f, err := os.Create(csvFileName)
+	if err != nil {
+		return DiffCounts{}, err
+	}
+	counts, err := d.Write(f)
+	if err != nil {
+		f.Close()
+		return counts, err
+	}
+	return counts, f.Close()
+}
+
+// nextUnique returns the row after previous, making sure it doesn't have
+// the same key.
+func nextUnique(rows *sortedRows, keys []int, previous []string) ([]string, error) {
+	row, err := rows.next()
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && compareKeys(previous, row, keys) == 0 {
+		key := make([]string, len(keys))
+		for i, k := range keys {
+			key[i] = row[k]
+		}
+		return nil, fmt.Errorf("more than one row has the key %s", strings.Join(key, ", "))
+	}
+	return row, nil
+}
+
+func compareKeys(a, b []string, keys []int) int {
+	for _, k := range keys {
+		if order := strings.Compare(a[k], b[k]); order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+func columnIndexes(columns, names []string) ([]int, error) {
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		indexes[i] = -1
+		for n, column := range columns {
+			if column == name {
+				indexes[i] = n
+				break
+			}
+		}
+		if indexes[i] == -1 {
+			return nil, fmt.Errorf("no column %s", name)
+		}
+	}
+	return indexes, nil
+}
+
+// sort reads source into a sorter ordered by the Keys, returning its
+// columns and the sorted rows. Given order, rows are rearranged to have
+// those columns in that order.
+func (d Diff) sort(source DiffSource, order []string) ([]string, *sortedRows, error) {
+	var sorter *externalSorter
+	var reorder []int
+	var mu sync.Mutex
+	var addErr error
+	start := func(columns []string) error {
+		keys, err := columnIndexes(columns, d.Keys)
+		if err != nil {
+			return err
+		}
+		if order != nil {
+			if len(order) != len(columns) {
+				return fmt.Errorf("has columns %s, not %s", strings.Join(columns, ","), strings.Join(order, ","))
+			}
+			if reorder, err = columnIndexes(columns, order); err != nil {
+				return fmt.Errorf("has columns %s, not %s", strings.Join(columns, ","), strings.Join(order, ","))
+			}
+			keys, _ = columnIndexes(order, d.Keys)
+		}
+		sorter = newExternalSorter(func(a, b []string) bool { return compareKeys(a, b, keys) < 0 }, d.MemoryLimit, d.TempDir)
+		return nil
+	}
+	add := func(row []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if addErr != nil {
+			return
+		}
+		if reorder != nil {
+			if len(row) != len(reorder) {
+				addErr = fmt.Errorf("row has %d columns, not %d", len(row), len(reorder))
+				return
+			}
+			reordered := make([]string, len(reorder))
+			for i, n := range reorder {
+				reordered[i] = row[n]
+			}
+			row = reordered
+		}
+		addErr = sorter.add(row)
+	}
+
+	var columns []string
+	var err error
+	if source.Rows != nil {
+		columns, err = readRowsSource(source, start, add)
+	} else {
+		columns, err = readFileSource(source, start, add)
+	}
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		if sorter != nil {
+			sorter.remove()
+		}
+		return nil, nil, err
+	}
+	if order != nil {
+		columns = order
+	}
+	sorted, err := sorter.sorted()
+	return columns, sorted, err
+}
+
+// readRowsSource formats the rows with a Converter, handing each to add.
+// The columns are named by the Converter's headers, so they follow any
+// RenameColumns or Headers.
+func readRowsSource(source DiffSource, start func(columns []string) error, add func(row []string)) ([]string, error) {
+	converter := New(source.Rows)
+	if source.Configure != nil {
+		source.Configure(converter)
+	}
+	converter.WriteHeaders = false
+	converter.WriteComments = false
+	converter.Encryption = nil
+	converter.stats = &writeStats{}
+
+	// with Concurrency the processor runs on several workers at once
+	var mu sync.Mutex
+	var started bool
+	var startErr error
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		mu.Lock()
+		if !started {
+			started, startErr = true, start(converter.stats.columns)
+		}
+		err := startErr
+		mu.Unlock()
+		if err == nil {
+			add(row)
+		}
+		return nil
+	})
+	if err := converter.Write(io.Discard); err != nil {
+		return nil, err
+	}
+	if started {
+		return converter.stats.columns, startErr
+	}
+	// no rows, so nothing has started yet
+	return converter.stats.columns, start(converter.stats.columns)
+}
+
+// readFileSource reads the CSV file, handing each row to add.
+func readFileSource(source DiffSource, start func(columns []string) error, add func(row []string)) ([]string, error) {
+	if source.File == "" {
+		return nil, errors.New("DiffSource needs Rows or a File")
+	}
+	f, err := os.Open(source.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buffered := bufio.NewReader(f)
+	if bom, _ := buffered.Peek(len(utf8BOM)); string(bom) == utf8BOM {
+		buffered.Discard(len(utf8BOM))
+	}
+	r := csv.NewReader(buffered)
+	if source.Delimiter != 0 {
+		r.Comma = source.Delimiter
+	}
+	r.ReuseRecord = true
+
+	columns, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header: %w", err)
+	}
+	columns = append([]string(nil), columns...)
+	if err = start(columns); err != nil {
+		return nil, err
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return columns, nil
+		} else if err != nil {
+			return nil, err
+		}
+		add(row)
+	}
+}
@@ -0,0 +1,157 @@
+package sqltocsv_test
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestDiffRows(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|before|id=int32,name=string,age=int32")
+	exec(t, db, "CREATE|after|id=int32,name=string,age=int32")
+	for _, row := range []string{"1,Alice,30", "2,Bob,40", "3,Carol,50"} {
+		cells := strings.Split(row, ",")
+		exec(t, db, "INSERT|before|id="+cells[0]+",name="+cells[1]+",age="+cells[2])
+	}
+	for _, row := range []string{"4,Dan,20", "3,Carol,50", "1,Alicia,31"} {
+		cells := strings.Split(row, ",")
+		exec(t, db, "INSERT|after|id="+cells[0]+",name="+cells[1]+",age="+cells[2])
+	}
+
+	diff := sqltocsv.Diff{
+		Old:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|before|id,name,age|")},
+		New:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|after|id,name,age|")},
+		Keys: []string{"id"},
+	}
+	var buf bytes.Buffer
+	counts, err := diff.Write(&buf)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	assertCsvMatch(t, `change,changed_columns,id,name,age
+modified,name;age,1,Alicia,31
+removed,,2,Bob,40
+added,,4,Dan,20
+`, buf.String())
+	if counts != (sqltocsv.DiffCounts{Added: 1, Removed: 1, Modified: 1}) {
+		t.Errorf("unexpected counts %+v", counts)
+	}
+}
+
+func TestDiffRenamedColumnsAgainstNoRows(t *testing.T) {
+	db := setupEventsDatabase(t, 50)
+	exec(t, db, "CREATE|empty|name=string,count=int64")
+	configure := func(c *sqltocsv.Converter) {
+		c.RenameColumns = map[string]string{"name": "label"}
+		c.Concurrency = 4
+	}
+
+	diff := sqltocsv.Diff{
+		Old:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|empty|name,count|"), Configure: configure},
+		New:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|events|name,count|"), Configure: configure},
+		Keys: []string{"count"},
+	}
+	var buf bytes.Buffer
+	counts, err := diff.Write(&buf)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "change,changed_columns,label,count\nadded,,event,0\n") {
+		t.Errorf("expected renamed headers, got\n%s", buf.String()[:80])
+	}
+	if counts != (sqltocsv.DiffCounts{Added: 50}) {
+		t.Errorf("unexpected counts %+v", counts)
+	}
+
+	// and the other way round, where the columns come from the side with rows
+	diff.Old, diff.New = diff.New, sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|empty|name,count|"), Configure: configure}
+	diff.Old.Rows = queryRows(t, db, "SELECT|events|name,count|")
+	if counts, err = diff.Write(&bytes.Buffer{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if counts != (sqltocsv.DiffCounts{Removed: 50}) {
+		t.Errorf("unexpected counts %+v", counts)
+	}
+}
+
+func TestDiffFileAgainstRowsOnDisk(t *testing.T) {
+	db := setupEventsDatabase(t, 25)
+	dir := t.TempDir()
+
+	// yesterday's export, with its columns in another order
+	var old bytes.Buffer
+	converter := sqltocsv.New(queryRows(t, db, "SELECT|events|name,count|"))
+	converter.Delimiter = ';'
+	converter.ExcelSafe = true
+	if err := converter.Write(&old); err != nil {
+		t.Fatal(err)
+	}
+	oldFile := filepath.Join(dir, "old.csv")
+	os.WriteFile(oldFile, []byte(strings.Replace(old.String(), "event;7\n", "renamed;7\n", 1)), 0644)
+
+	exec(t, db, "INSERT|events|name=event,count=?", int64(25))
+	diff := sqltocsv.Diff{
+		Old:         sqltocsv.DiffSource{File: oldFile, Delimiter: ';'},
+		New:         sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|events|count,name|")},
+		Keys:        []string{"count"},
+		MemoryLimit: 200, // forces sorted runs on disk
+		TempDir:     dir,
+	}
+	diffFile := filepath.Join(dir, "diff.csv")
+	counts, err := diff.WriteFile(diffFile)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	actual, _ := os.ReadFile(diffFile)
+	assertCsvMatch(t, "change,changed_columns,count,name\nadded,,25,event\nmodified,name,7,event\n", string(actual))
+	if counts.Added != 1 || counts.Modified != 1 || counts.Removed != 0 {
+		t.Errorf("unexpected counts %+v", counts)
+	}
+
+	runs, _ := filepath.Glob(filepath.Join(dir, "sqltocsv-sort-*"))
+	if len(runs) > 0 {
+		t.Errorf("expected sorted runs to be removed, found %v", runs)
+	}
+}
+
+func TestDiffDuplicateKey(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "INSERT|people|name=Alice,age=?", 2)
+
+	diff := sqltocsv.Diff{
+		Old:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|people|name,age|")},
+		New:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|people|name,age|")},
+		Keys: []string{"name"},
+	}
+	_, err := diff.Write(&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "more than one row has the key Alice") {
+		t.Errorf("expected a duplicate key error, got %v", err)
+	}
+}
+
+func TestDiffDifferentColumns(t *testing.T) {
+	db := setupDatabase(t)
+
+	diff := sqltocsv.Diff{
+		Old:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|people|name,age|")},
+		New:  sqltocsv.DiffSource{Rows: queryRows(t, db, "SELECT|people|name,bdate|")},
+		Keys: []string{"name"},
+	}
+	if _, err := diff.Write(&bytes.Buffer{}); err == nil {
+		t.Error("expected an error for sides with different columns")
+	}
+}
+
+func queryRows(t *testing.T, db *sql.DB, query string) *sql.Rows {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
@@ -0,0 +1,359 @@
+package sqltocsv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Dialect is how DumpSchema finds the tables and columns of a schema on a
+// particular database. PostgreSQL, MySQL and SQLite are provided.
+type Dialect struct {
+	// Tables lists the names of the tables in schema
+	Tables func(schema string) (query string, args []interface{})
+	// Columns lists table's columns in order as name, type, and YES or NO
+	// for whether it's nullable
+	Columns func(schema, table string) (query string, args []interface{})
+	// Select reads every row of table (default is SELECT columns FROM table)
+	Select func(schema, table string, columns []string) string
+	// DDL returns one row holding table's CREATE TABLE statement (default
+	// is to build one from Columns)
+	DDL func(schema, table string) (query string, args []interface{})
+	// Quote quotes an identifier (default is double quotes)
+	Quote func(name string) string
+}
+
+// PostgreSQL finds tables through information_schema, and their column
+// types through pg_catalog so they keep their lengths and element types.
+// The schema defaults to public, whatever the search_path.
+var PostgreSQL = Dialect{
+	Tables: func(schema string) (string, []interface{}) {
+		return `SELECT table_name FROM information_schema.tables
+			WHERE table_schema = $1 AND table_type = 'BASE TABLE' ORDER BY table_name`,
+			[]interface{}{defaultSchema(schema, "public")}
+	},
+	Columns: func(schema, table string) (string, []interface{}) {
+		return `SELECT a.attname, format_type(a.atttypid, a.atttypmod),
+				CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END
+			FROM pg_catalog.pg_attribute a
+			JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2 AND a.attnum > 0 AND NOT a.attisdropped
+			ORDER BY a.attnum`,
+			[]interface{}{defaultSchema(schema, "public"), table}
+	},
+	Select: func(schema, table string, columns []string) string {
+		return selectAll(quoteIdentifier, defaultSchema(schema, "public"), table, columns)
+	},
+}
+
+// MySQL finds tables through information_schema. The schema defaults to
+// the connection's current database.
+var MySQL = Dialect{
+	Tables: func(schema string) (string, []interface{}) {
+		return `SELECT table_name FROM information_schema.tables
+			WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_type = 'BASE TABLE' ORDER BY table_name`,
+			[]interface{}{schema}
+	},
+	Columns: func(schema, table string) (string, []interface{}) {
+		return `SELECT column_name, column_type, is_nullable FROM information_schema.columns
+			WHERE table_schema = COALESCE(NULLIF(?, ''), DATABASE()) AND table_name = ? ORDER BY ordinal_position`,
+			[]interface{}{schema, table}
+	},
+	Select: func(schema, table string, columns []string) string {
+		return selectAll(quoteBackticks, schema, table, columns)
+	},
+	Quote: quoteBackticks,
+}
+
+// SQLite finds tables through sqlite_master, and takes their DDL from
+// there too. The schema is ignored.
+var SQLite = Dialect{
+	Tables: func(string) (string, []interface{}) {
+		return `SELECT name FROM sqlite_master
+			WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' ORDER BY name`, nil
+	},
+	Columns: func(_, table string) (string, []interface{}) {
+		return `SELECT name, type, CASE WHEN "notnull" = 0 THEN 'YES' ELSE 'NO' END
+			FROM pragma_table_info(?) ORDER BY cid`, []interface{}{table}
+	},
+	Select: func(_, table string, columns []string) string {
+		return selectAll(quoteIdentifier, "", table, columns)
+	},
+	DDL: func(_, table string) (string, []interface{}) {
+		return `SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, []interface{}{table}
+	},
+}
+
+func defaultSchema(schema, fallback string) string {
+	if schema == "" {
+		return fallback
+	}
+	return schema
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteBackticks(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func selectAll(quote func(string) string, schema, table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quote(column)
+	}
+	from := quote(table)
+	if schema != "" {
+		from = quote(schema) + "." + from
+	}
+	return "SELECT " + strings.Join(quoted, ", ") + " FROM " + from
+}
+
+// DumpOptions says what DumpSchema exports and how.
+type DumpOptions struct {
+	Dialect     Dialect
+	Schema      string                           // schema to dump (default depends on the Dialect)
+	Include     []string                         // path.Match patterns of table names to dump (default is all of them)
+	Exclude     []string                         // path.Match patterns of table names to leave out
+	Concurrency int                              // tables exported at once (default is 4)
+	WriteDDL    bool                             // write each table's CREATE TABLE to table.sql
+	Configure   func(table string, c *Converter) // sets up the Converter for each table (optional)
+}
+
+// DumpManifest lists the tables DumpSchema wrote. It is saved as JSON in
+// manifest.json in the dump's directory.
+type DumpManifest struct {
+	Schema   string      `json:"schema,omitempty"`
+	Tables   []DumpTable `json:"tables"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+}
+
+// DumpTable describes one table's file in a DumpManifest.
+type DumpTable struct {
+	Name    string       `json:"name"`
+	File    string       `json:"file"`
+	DDLFile string       `json:"ddl_file,omitempty"`
+	SHA256  string       `json:"sha256"`
+	Bytes   int64        `json:"bytes"`
+	Rows    int64        `json:"rows"`
+	Columns []DumpColumn `json:"columns"`
+}
+
+// DumpColumn is a column of a DumpTable as the database describes it.
+type DumpColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// DumpSchema exports every table in a schema to its own CSV file in dir,
+// named after the table, and writes a manifest.json listing them. Tables
+// are exported as a Batch, so each is consistent on its own but not with
+// the others. A table that fails leaves no file, and the DDL and manifest
+// are only written once they've all succeeded. Table names that can't be
+// file names, or that only differ in case, fail the dump before any table
+// is exported.
+func DumpSchema(ctx context.Context, db *sql.DB, dir string, options DumpOptions) ([]BatchResult, error) {
+	started := time.Now()
+	dialect := options.Dialect
+	if dialect.Tables == nil || dialect.Columns == nil {
+		return nil, errors.New("DumpSchema needs a Dialect")
+	}
+	if dialect.Quote == nil {
+		dialect.Quote = quoteIdentifier
+	}
+
+	tables, err := dialect.tables(ctx, db, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkTableNames(tables); err != nil {
+		return nil, err
+	}
+
+	manifest := DumpManifest{Schema: options.Schema, Tables: make([]DumpTable, 0, len(tables))}
+	jobs := make([]BatchJob, len(tables))
+	for i, table := range tables {
+		columns, err := dialect.columns(ctx, db, options.Schema, table)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append(manifest.Tables, DumpTable{Name: table, File: table + ".csv", Columns: columns})
+
+		names := make([]string, len(columns))
+		for n, column := range columns {
+			names[n] = column.Name
+		}
+		jobs[i] = BatchJob{Name: table, Query: dialect.selectQuery(options.Schema, table, names)}
+		if options.Configure != nil {
+			table := table
+			jobs[i].Configure = func(c *Converter) { options.Configure(table, c) }
+		}
+	}
+
+	results := Batch{DB: db, Dir: dir, Jobs: jobs, Concurrency: options.Concurrency}.Run(ctx)
+	var failed []string
+	var firstErr error
+	for i, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Name)
+			if firstErr == nil {
+				firstErr = result.Err
+			}
+			continue
+		}
+		manifest.Tables[i].SHA256 = result.SHA256
+		manifest.Tables[i].Bytes = result.Bytes
+		manifest.Tables[i].Rows = result.Rows
+	}
+	if firstErr != nil {
+		return results, fmt.Errorf("%d of %d tables failed (%s): %w", len(failed), len(results), strings.Join(failed, ", "), firstErr)
+	}
+
+	if options.WriteDDL {
+		for i, table := range manifest.Tables {
+			manifest.Tables[i].DDLFile = table.Name + ".sql"
+			if err = dialect.writeDDL(ctx, db, options.Schema, table.Name, table.Columns, filepath.Join(dir, table.Name+".sql")); err != nil {
+				return results, err
+			}
+		}
+	}
+
+	manifest.Started = started.UTC()
+	manifest.Finished = time.Now().UTC()
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return results, err
+	}
+	return results, os.WriteFile(filepath.Join(dir, "manifest.json"), append(encoded, '\n'), 0644)
+}
+
+// tables lists the schema's tables that options include.
+func (d Dialect) tables(ctx context.Context, db *sql.DB, options DumpOptions) ([]string, error) {
+	for _, pattern := range append(options.Include[:len(options.Include):len(options.Include)], options.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("table pattern %q: %w", pattern, err)
+		}
+	}
+
+	query, args := d.Tables(options.Schema)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("listing tables: %w", err)
+		}
+		if matchesAny(options.Include, table, true) && !matchesAny(options.Exclude, table, false) {
+			tables = append(tables, table)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+	return tables, nil
+}
+
+// checkTableNames makes sure every table can be written to a file of its
+// own in the dump's directory.
+func checkTableNames(tables []string) error {
+	folded := map[string]string{}
+	for _, table := range tables {
+		if err := checkFileName(table); err != nil {
+			return fmt.Errorf("can't dump table %q to a file: %w", table, err)
+		}
+		if other, ok := folded[strings.ToLower(table)]; ok {
+			return fmt.Errorf("tables %q and %q would be written to the same file on a case-insensitive file system", other, table)
+		}
+		folded[strings.ToLower(table)] = table
+	}
+	return nil
+}
+
+// matchesAny reports whether name matches any of patterns, or ifNone
+// when there are no patterns.
+func matchesAny(patterns []string, name string, ifNone bool) bool {
+	if len(patterns) == 0 {
+		return ifNone
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Dialect) columns(ctx context.Context, db *sql.DB, schema, table string) ([]DumpColumn, error) {
+	query, args := d.Columns(schema, table)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var columns []DumpColumn
+	for rows.Next() {
+		var column DumpColumn
+		var nullable string
+		if err = rows.Scan(&column.Name, &column.Type, &nullable); err != nil {
+			return nil, fmt.Errorf("listing columns of %s: %w", table, err)
+		}
+		column.Nullable = strings.EqualFold(nullable, "YES")
+		columns = append(columns, column)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing columns of %s: %w", table, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s has no columns", table)
+	}
+	return columns, nil
+}
+
+func (d Dialect) selectQuery(schema, table string, columns []string) string {
+	if d.Select != nil {
+		return d.Select(schema, table, columns)
+	}
+	return selectAll(d.Quote, schema, table, columns)
+}
+
+// writeDDL writes table's CREATE TABLE statement to fileName. Built from
+// the columns it only has their types and nullability, not keys, indexes
+// or defaults.
+func (d Dialect) writeDDL(ctx context.Context, db *sql.DB, schema, table string, columns []DumpColumn, fileName string) error {
+	var ddl string
+	if d.DDL != nil {
+		query, args := d.DDL(schema, table)
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&ddl); err != nil {
+			return fmt.Errorf("reading the DDL of %s: %w", table, err)
+		}
+	} else {
+		definitions := make([]string, len(columns))
+		for i, column := range columns {
+			definitions[i] = "  " + d.Quote(column.Name) + " " + column.Type
+			if !column.Nullable {
+				definitions[i] += " NOT NULL"
+			}
+		}
+		ddl = "CREATE TABLE " + d.Quote(table) + " (\n" + strings.Join(definitions, ",\n") + "\n)"
+	}
+	return os.WriteFile(fileName, []byte(strings.TrimRight(ddl, "; \n")+";\n"), 0644)
+}
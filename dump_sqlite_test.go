@@ -0,0 +1,84 @@
+//go:build sqlite
+
+package sqltocsv_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+	_ "modernc.org/sqlite"
+)
+
+// Run with go test -tags sqlite to dump a real SQLite database, which
+// checks the SQLite Dialect's catalog queries against the database
+// rather than as strings.
+func TestDumpSchemaSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "shop.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		// AUTOINCREMENT makes SQLite keep the sqlite_sequence table
+		`CREATE TABLE orders (id INTEGER PRIMARY KEY AUTOINCREMENT, item VARCHAR(20) NOT NULL, price REAL)`,
+		`CREATE TABLE "odd""name" (note TEXT)`,
+		`CREATE TABLE sqlitebrowser_rename (x INT)`,
+		`INSERT INTO orders (item, price) VALUES ('widget', 2.5), ('gadget', NULL)`,
+		`INSERT INTO "odd""name" VALUES ('quoted')`,
+	} {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+
+	dir := t.TempDir()
+	results, err := sqltocsv.DumpSchema(context.Background(), db, dir, sqltocsv.DumpOptions{
+		Dialect:     sqltocsv.SQLite,
+		Concurrency: 1,
+		WriteDDL:    true,
+	})
+	if err != nil {
+		t.Fatalf("DumpSchema failed: %v", err)
+	}
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Name)
+	}
+	if !reflect.DeepEqual(names, []string{`odd"name`, "orders", "sqlitebrowser_rename"}) {
+		t.Errorf("expected every table but sqlite_sequence, got %v", names)
+	}
+
+	actual, _ := os.ReadFile(filepath.Join(dir, "orders.csv"))
+	assertCsvMatch(t, "id,item,price\n1,widget,2.5\n2,gadget,\n", string(actual))
+	actual, _ = os.ReadFile(filepath.Join(dir, `odd"name.csv`))
+	assertCsvMatch(t, "note\nquoted\n", string(actual))
+
+	ddl, _ := os.ReadFile(filepath.Join(dir, "orders.sql"))
+	expectedDDL := "CREATE TABLE orders (id INTEGER PRIMARY KEY AUTOINCREMENT, item VARCHAR(20) NOT NULL, price REAL);\n"
+	if string(ddl) != expectedDDL {
+		t.Errorf("expected DDL\n%s\ngot\n%s", expectedDDL, ddl)
+	}
+
+	encoded, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest sqltocsv.DumpManifest
+	if err = json.Unmarshal(encoded, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	expectedColumns := []sqltocsv.DumpColumn{
+		{Name: "id", Type: "INTEGER", Nullable: true},
+		{Name: "item", Type: "VARCHAR(20)", Nullable: false},
+		{Name: "price", Type: "REAL", Nullable: true},
+	}
+	if !reflect.DeepEqual(manifest.Tables[1].Columns, expectedColumns) {
+		t.Errorf("expected columns %+v, got %+v", expectedColumns, manifest.Tables[1].Columns)
+	}
+}
@@ -0,0 +1,237 @@
+package sqltocsv_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+// fakeDialect reads the fake database's catalog from tables the test
+// fills in, standing in for information_schema.
+var fakeDialect = sqltocsv.Dialect{
+	Tables: func(string) (string, []interface{}) {
+		return "SELECT|catalog_tables|name|", nil
+	},
+	Columns: func(_, table string) (string, []interface{}) {
+		return "SELECT|catalog_columns|name,type,nullable|tbl=?", []interface{}{table}
+	},
+	Select: func(_, table string, columns []string) string {
+		return "SELECT|" + table + "|" + strings.Join(columns, ",") + "|"
+	},
+}
+
+func setupCatalog(t *testing.T) *sql.DB {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|pets|name=string,legs=int32")
+	exec(t, db, "INSERT|pets|name=Rex,legs=4")
+	exec(t, db, "INSERT|pets|name=Polly,legs=2")
+
+	exec(t, db, "CREATE|catalog_tables|name=string")
+	exec(t, db, "CREATE|catalog_columns|tbl=string,name=string,type=string,nullable=string")
+	for _, table := range []string{"people", "pets", "audit_log"} {
+		exec(t, db, "INSERT|catalog_tables|name=?", table)
+	}
+	for _, column := range [][]string{
+		{"people", "name", "text", "NO"},
+		{"people", "age", "integer", "YES"},
+		{"pets", "name", "text", "NO"},
+		{"pets", "legs", "integer", "YES"},
+		{"audit_log", "entry", "text", "YES"},
+	} {
+		exec(t, db, "INSERT|catalog_columns|tbl=?,name=?,type=?,nullable=?", column[0], column[1], column[2], column[3])
+	}
+	return db
+}
+
+func TestDumpSchema(t *testing.T) {
+	db := setupCatalog(t)
+	dir := t.TempDir()
+
+	results, err := sqltocsv.DumpSchema(context.Background(), db, dir, sqltocsv.DumpOptions{
+		Dialect:  fakeDialect,
+		Exclude:  []string{"audit_*"},
+		WriteDDL: true,
+		Configure: func(table string, c *sqltocsv.Converter) {
+			if table == "pets" {
+				c.Delimiter = ';'
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("DumpSchema failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 tables dumped, got %+v", results)
+	}
+
+	actual, _ := os.ReadFile(filepath.Join(dir, "people.csv"))
+	assertCsvMatch(t, "name,age\nAlice,1\n", string(actual))
+	actual, _ = os.ReadFile(filepath.Join(dir, "pets.csv"))
+	assertCsvMatch(t, "name;legs\nRex;4\nPolly;2\n", string(actual))
+	if _, err = os.Stat(filepath.Join(dir, "audit_log.csv")); !os.IsNotExist(err) {
+		t.Error("expected the excluded table not to be dumped")
+	}
+
+	ddl, _ := os.ReadFile(filepath.Join(dir, "pets.sql"))
+	expectedDDL := "CREATE TABLE \"pets\" (\n  \"name\" text NOT NULL,\n  \"legs\" integer\n);\n"
+	if string(ddl) != expectedDDL {
+		t.Errorf("expected DDL\n%s\ngot\n%s", expectedDDL, ddl)
+	}
+
+	encoded, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest sqltocsv.DumpManifest
+	if err = json.Unmarshal(encoded, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	pets := manifest.Tables[1]
+	if len(manifest.Tables) != 2 || pets.File != "pets.csv" || pets.DDLFile != "pets.sql" || pets.Rows != 2 ||
+		pets.Bytes != 24 || len(pets.SHA256) != 64 || !pets.Columns[1].Nullable || pets.Columns[0].Nullable {
+		t.Errorf("unexpected manifest %s", encoded)
+	}
+}
+
+func TestDumpSchemaInclude(t *testing.T) {
+	db := setupCatalog(t)
+	dir := t.TempDir()
+
+	results, err := sqltocsv.DumpSchema(context.Background(), db, dir, sqltocsv.DumpOptions{
+		Dialect: fakeDialect,
+		Include: []string{"pe?s"},
+	})
+	if err != nil {
+		t.Fatalf("DumpSchema failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "pets" {
+		t.Errorf("expected only pets, got %+v", results)
+	}
+}
+
+func TestDumpSchemaFailedTable(t *testing.T) {
+	db := setupCatalog(t)
+	dir := t.TempDir()
+
+	// audit_log is in the catalog but not the database
+	_, err := sqltocsv.DumpSchema(context.Background(), db, dir, sqltocsv.DumpOptions{Dialect: fakeDialect})
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 tables failed (audit_log)") {
+		t.Fatalf("expected audit_log to fail, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+		t.Error("expected no manifest for a failed dump")
+	}
+}
+
+func TestDumpSchemaBadPattern(t *testing.T) {
+	db := setupDatabase(t)
+	_, err := sqltocsv.DumpSchema(context.Background(), db, t.TempDir(), sqltocsv.DumpOptions{
+		Dialect: fakeDialect,
+		Include: []string{"["},
+	})
+	if err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+}
+
+func TestDumpSchemaTableNames(t *testing.T) {
+	for _, test := range []struct {
+		table    string
+		expected string
+	}{
+		{"../escape", `can't dump table "../escape" to a file`},
+		{`dir\file`, `isn't a plain file name`},
+		{"..", `isn't a plain file name`},
+		{"", "the name is empty"},
+		{"Pets", `tables "pets" and "Pets" would be written to the same file`},
+	} {
+		db := setupCatalog(t)
+		dir := t.TempDir()
+		exec(t, db, "INSERT|catalog_tables|name=?", test.table)
+
+		_, err := sqltocsv.DumpSchema(context.Background(), db, dir, sqltocsv.DumpOptions{Dialect: fakeDialect})
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%q: expected an error %s, got %v", test.table, test.expected, err)
+		}
+		if files, _ := os.ReadDir(dir); len(files) > 0 {
+			t.Errorf("%q: expected nothing written, got %v", test.table, files)
+		}
+	}
+}
+
+func TestDialectSelectQueries(t *testing.T) {
+	columns := []string{"id", `odd"name`}
+	for _, test := range []struct {
+		name     string
+		dialect  sqltocsv.Dialect
+		schema   string
+		expected string
+	}{
+		{"PostgreSQL", sqltocsv.PostgreSQL, "sales", `SELECT "id", "odd""name" FROM "sales"."orders"`},
+		// the same schema the catalog queries default to, not the search_path
+		{"PostgreSQL public", sqltocsv.PostgreSQL, "", `SELECT "id", "odd""name" FROM "public"."orders"`},
+		{"MySQL", sqltocsv.MySQL, "", "SELECT `id`, `odd\"name` FROM `orders`"},
+		{"SQLite", sqltocsv.SQLite, "main", `SELECT "id", "odd""name" FROM "orders"`},
+	} {
+		if actual := test.dialect.Select(test.schema, "orders", columns); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestDialectCatalogQueries(t *testing.T) {
+	type query struct {
+		name     string
+		query    string
+		args     []interface{}
+		expected []interface{}
+		contains string
+	}
+	var queries []query
+	add := func(name string, q string, args []interface{}, expected []interface{}, contains string) {
+		queries = append(queries, query{name, q, args, expected, contains})
+	}
+	q, args := sqltocsv.PostgreSQL.Tables("")
+	add("PostgreSQL tables", q, args, []interface{}{"public"}, "table_schema = $1")
+	q, args = sqltocsv.PostgreSQL.Columns("sales", `odd"table`)
+	add("PostgreSQL columns", q, args, []interface{}{"sales", `odd"table`}, "format_type(a.atttypid, a.atttypmod)")
+	// an empty schema falls back to the connection's database
+	q, args = sqltocsv.MySQL.Tables("")
+	add("MySQL tables", q, args, []interface{}{""}, "COALESCE(NULLIF(?, ''), DATABASE())")
+	q, args = sqltocsv.MySQL.Columns("shop", "orders")
+	add("MySQL columns", q, args, []interface{}{"shop", "orders"}, "table_name = ?")
+	q, args = sqltocsv.SQLite.Tables("main")
+	add("SQLite tables", q, args, nil, `NOT LIKE 'sqlite\_%' ESCAPE '\'`)
+	q, args = sqltocsv.SQLite.Columns("main", `odd"table`)
+	add("SQLite columns", q, args, []interface{}{`odd"table`}, "pragma_table_info(?)")
+	q, args = sqltocsv.SQLite.DDL("main", "orders")
+	add("SQLite DDL", q, args, []interface{}{"orders"}, "name = ?")
+
+	for _, test := range queries {
+		if !reflect.DeepEqual(test.args, test.expected) {
+			t.Errorf("%s: expected args %q, got %q", test.name, test.expected, test.args)
+		}
+		if !strings.Contains(test.query, test.contains) {
+			t.Errorf("%s: expected %s in\n%s", test.name, test.contains, test.query)
+		}
+		// every argument has a placeholder, and nothing is spliced in
+		placeholders := strings.Count(test.query, "?")
+		if strings.Contains(test.query, "$1") {
+			placeholders = strings.Count(test.query, "$")
+		}
+		if placeholders != len(test.args) {
+			t.Errorf("%s: %d placeholders for %d args in\n%s", test.name, placeholders, len(test.args), test.query)
+		}
+	}
+
+	if actual := sqltocsv.MySQL.Quote("odd`name"); actual != "`odd``name`" {
+		t.Errorf("expected backticks doubled, got %s", actual)
+	}
+}
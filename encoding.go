@@ -0,0 +1,251 @@
+package sqltocsv
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding is the character encoding a Converter writes its CSV in.
+type Encoding string
+
+// Encodings supported by Converter.
+const (
+	UTF8        Encoding = "utf-8"
+	UTF16LE     Encoding = "utf-16le"
+	UTF16BE     Encoding = "utf-16be"
+	Windows1252 Encoding = "windows-1252"
+	ISO88591    Encoding = "iso-8859-1"
+)
+
+// UnrepresentablePolicy says what to do with a character the output
+// Encoding has no code for.
+type UnrepresentablePolicy int
+
+const (
+	// UnrepresentableError stops the conversion with an error (the default)
+	UnrepresentableError UnrepresentablePolicy = iota
+	// UnrepresentableReplace writes a ? in place of the character
+	UnrepresentableReplace
+	// UnrepresentableTransliterate writes the closest ASCII equivalent
+	// (Ł becomes L, — becomes -) falling back to ? when there isn't one
+	UnrepresentableTransliterate
+)
+
+// InvalidUTF8Policy says what to do when a []byte column isn't valid UTF-8.
+type InvalidUTF8Policy int
+
+const (
+	// InvalidUTF8Pass writes the bytes through untouched (the default)
+	InvalidUTF8Pass InvalidUTF8Policy = iota
+	// InvalidUTF8Replace swaps each invalid sequence for U+FFFD
+	InvalidUTF8Replace
+	// InvalidUTF8Error stops the conversion with an error
+	InvalidUTF8Error
+)
+
+// checkUTF8 applies policy to a string that came from a []byte column.
+func checkUTF8(value string, columnName string, policy InvalidUTF8Policy) (string, error) {
+	if policy == InvalidUTF8Pass || utf8.ValidString(value) {
+		return value, nil
+	}
+	if policy == InvalidUTF8Replace {
+		return strings.ToValidUTF8(value, string(utf8.RuneError)), nil
+	}
+	return "", fmt.Errorf("column %q contains invalid UTF-8", columnName)
+}
+
+// byteOrderMark returns the BOM for enc, or an empty string for the single
+// byte encodings which don't have one.
+func byteOrderMark(enc Encoding) string {
+	switch enc {
+	case UTF16LE:
+		return "\xFF\xFE"
+	case UTF16BE:
+		return "\xFE\xFF"
+	case Windows1252, ISO88591:
+		return ""
+	}
+	return utf8BOM
+}
+
+// newEncodingWriter returns a writer which transcodes the UTF-8 written to
+// it into enc before passing it on to w. It returns w untouched for UTF-8.
+func newEncodingWriter(w io.Writer, enc Encoding, policy UnrepresentablePolicy) (io.Writer, error) {
+	switch enc {
+	case "", UTF8:
+		return w, nil
+	case UTF16LE, UTF16BE, Windows1252, ISO88591:
+		return &encodingWriter{w: w, enc: enc, policy: policy}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", enc)
+}
+
+// encodingWriter transcodes a UTF-8 byte stream. The csv package writes in
+// arbitrary chunks so a rune can be split across calls to Write; any
+// incomplete trailing sequence is held back until the next Write.
+type encodingWriter struct {
+	w       io.Writer
+	enc     Encoding
+	policy  UnrepresentablePolicy
+	pending []byte
+	out     []byte
+}
+
+func (e *encodingWriter) Write(p []byte) (int, error) {
+	buf := p
+	if len(e.pending) > 0 {
+		buf = append(e.pending, p...)
+		e.pending = nil
+	}
+	e.out = e.out[:0]
+
+	for len(buf) > 0 {
+		if !utf8.FullRune(buf) {
+			e.pending = append([]byte(nil), buf...)
+			break
+		}
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && size == 1 {
+			r = -1 // mark as invalid so it can't be mistaken for a literal U+FFFD
+		}
+		if err := e.encodeRune(r); err != nil {
+			return 0, err
+		}
+		buf = buf[size:]
+	}
+
+	if _, err := e.w.Write(e.out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close flushes anything held back by Write. A dangling partial sequence at
+// the end of the stream is treated like any other unrepresentable input.
+func (e *encodingWriter) Close() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	e.pending = nil
+	e.out = e.out[:0]
+	if err := e.encodeRune(-1); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *encodingWriter) encodeRune(r rune) error {
+	switch e.enc {
+	case UTF16LE, UTF16BE:
+		if r < 0 {
+			return e.unrepresentable(r)
+		}
+		e.appendUTF16(r)
+		return nil
+	}
+
+	if b, ok := singleByte(e.enc, r); ok {
+		e.out = append(e.out, b)
+		return nil
+	}
+	return e.unrepresentable(r)
+}
+
+func (e *encodingWriter) appendUTF16(r rune) {
+	units := []uint16{uint16(r)}
+	if r >= 0x10000 {
+		r1, r2 := utf16.EncodeRune(r)
+		units = []uint16{uint16(r1), uint16(r2)}
+	}
+	for _, u := range units {
+		if e.enc == UTF16LE {
+			e.out = append(e.out, byte(u), byte(u>>8))
+		} else {
+			e.out = append(e.out, byte(u>>8), byte(u))
+		}
+	}
+}
+
+func (e *encodingWriter) unrepresentable(r rune) error {
+	switch e.policy {
+	case UnrepresentableReplace:
+		return e.encodeRune('?')
+	case UnrepresentableTransliterate:
+		for _, t := range transliterate(r) {
+			if err := e.encodeRune(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if r < 0 {
+		return fmt.Errorf("invalid UTF-8 cannot be encoded as %s", e.enc)
+	}
+	return fmt.Errorf("character %q (%U) cannot be encoded as %s", r, r, e.enc)
+}
+
+// singleByte returns the byte for r in one of the single byte encodings.
+func singleByte(enc Encoding, r rune) (byte, bool) {
+	if r < 0 || r > 0xFF {
+		if enc == Windows1252 {
+			return windows1252Byte(r)
+		}
+		return 0, false
+	}
+	// Windows-1252 swaps the C1 control codes at 0x80-0x9F for printable
+	// characters, otherwise both encodings match the first 256 code points
+	if enc == Windows1252 && r >= 0x80 && r < 0xA0 {
+		return 0, false
+	}
+	return byte(r), true
+}
+
+func windows1252Byte(r rune) (byte, bool) {
+	for i, cp := range windows1252High {
+		if cp != 0 && cp == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// windows1252High maps bytes 0x80-0x9F of Windows-1252 to Unicode. Zero
+// marks the five bytes the code page leaves undefined.
+var windows1252High = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// latinExtendedA holds the unaccented base letter for U+0100-U+017F.
+const latinExtendedA = "AaAaAaCcCcCcCcDdDdEeEeEeEeEeGgGg" +
+	"GgGgHhHhIiIiIiIiIiIiJjKkkLlLlLlL" +
+	"lLlNnNnNnnNnOoOoOoOoRrRrRrSsSsSs" +
+	"SsTtTtTtUuUuUuUuUuUuWwYyYZzZzZzs"
+
+var transliterations = map[rune]string{
+	0x0132: "IJ", 0x0133: "ij", 0x0152: "OE", 0x0153: "oe",
+	0x2018: "'", 0x2019: "'", 0x201A: "'", 0x2039: "<", 0x203A: ">",
+	// transliteration happens after CSV quoting, so curly double quotes
+	// become single quotes rather than a " which would corrupt the field
+	0x201C: "'", 0x201D: "'", 0x201E: "'",
+	0x2013: "-", 0x2014: "-", 0x2026: "...", 0x2022: "*",
+	0x20AC: "EUR", 0x2122: "TM", 0x2030: "%o", 0x02C6: "^", 0x02DC: "~",
+	0x0192: "f", 0x2020: "+", 0x2021: "+",
+}
+
+// transliterate returns an ASCII stand-in for r, or ? when there isn't one.
+func transliterate(r rune) string {
+	if t, ok := transliterations[r]; ok {
+		return t
+	}
+	if r >= 0x0100 && r <= 0x017F {
+		return latinExtendedA[r-0x0100 : r-0x0100+1]
+	}
+	return "?"
+}
@@ -0,0 +1,107 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestEncodingWindows1252(t *testing.T) {
+	converter := sqltocsv.New(getEncodingTestRows(t, "Zoë", "€5 “net”"))
+
+	converter.Encoding = sqltocsv.Windows1252
+
+	expected := "name,note\nZo\xEB,\x805 \x93net\x94\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestEncodingUTF16LEWithBOM(t *testing.T) {
+	converter := sqltocsv.New(getEncodingTestRows(t, "Zoë", "𝄞"))
+
+	converter.Encoding = sqltocsv.UTF16LE
+	converter.ExcelSafe = true
+
+	expected := "\xFF\xFE" +
+		"n\x00a\x00m\x00e\x00,\x00n\x00o\x00t\x00e\x00\n\x00" +
+		"Z\x00o\x00\xEB\x00,\x00\x34\xD8\x1E\xDD\n\x00"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestEncodingUnrepresentableError(t *testing.T) {
+	converter := sqltocsv.New(getEncodingTestRows(t, "Łukasz", "ok"))
+
+	converter.Encoding = sqltocsv.ISO88591
+
+	_, err := converter.WriteString()
+	if err == nil {
+		t.Fatal("expected an error for a character outside ISO-8859-1")
+	}
+}
+
+func TestEncodingUnrepresentableReplace(t *testing.T) {
+	converter := sqltocsv.New(getEncodingTestRows(t, "Łukasz", "中"))
+
+	converter.Encoding = sqltocsv.ISO88591
+	converter.Unrepresentable = sqltocsv.UnrepresentableReplace
+
+	expected := "name,note\n?ukasz,?\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestEncodingUnrepresentableTransliterate(t *testing.T) {
+	converter := sqltocsv.New(getEncodingTestRows(t, "Łukasz Œuvre", "“quoted” — 中"))
+
+	converter.Encoding = sqltocsv.ISO88591
+	converter.Unrepresentable = sqltocsv.UnrepresentableTransliterate
+
+	expected := "name,note\nLukasz OEuvre,'quoted' - ?\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestInvalidUTF8Policies(t *testing.T) {
+	newConverter := func() *sqltocsv.Converter {
+		db := setupDatabase(t)
+		exec(t, db, "CREATE|raw|data=blob")
+		exec(t, db, "INSERT|raw|data=?", []byte("ab\xFFc"))
+
+		rows, err := db.Query("SELECT|raw|data|")
+		if err != nil {
+			t.Fatalf("error querying: %v", err)
+		}
+		return sqltocsv.New(rows)
+	}
+
+	converter := newConverter()
+	assertCsvMatch(t, "data\nab\xFFc\n", converter.String())
+
+	converter = newConverter()
+	converter.InvalidUTF8 = sqltocsv.InvalidUTF8Replace
+	assertCsvMatch(t, "data\nab�c\n", converter.String())
+
+	converter = newConverter()
+	converter.InvalidUTF8 = sqltocsv.InvalidUTF8Error
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for invalid UTF-8")
+	}
+}
+
+func getEncodingTestRows(t *testing.T, name, note string) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|accents|name=string,note=string")
+	exec(t, db, "INSERT|accents|name=?,note=?", name, note)
+
+	rows, err := db.Query("SELECT|accents|name,note|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
@@ -0,0 +1,309 @@
+package sqltocsv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encryption configures authenticated encryption of the CSV. Set either
+// Passphrase or Recipient to encrypt; to decrypt use the same Passphrase,
+// or the Identity whose public key was the Recipient.
+//
+// The output is split into 64KiB chunks, each sealed with AES-256-GCM
+// under a nonce that counts the chunks and marks the last one, so any
+// tampering, reordering or truncation is caught on decryption.
+type Encryption struct {
+	Passphrase string           // key derived with PBKDF2-SHA256
+	Recipient  *ecdh.PublicKey  // X25519 public key to encrypt to
+	Identity   *ecdh.PrivateKey // X25519 private key to decrypt with
+}
+
+// ErrDecrypt is returned when encrypted output has been tampered with,
+// truncated, or the wrong key is used.
+var ErrDecrypt = errors.New("encrypted output failed authentication")
+
+const (
+	encryptionMagic       = "sqltocsv\x00enc1"
+	encryptionChunkSize   = 64 * 1024
+	encryptionNoncePrefix = 7
+	pbkdf2Iterations      = 600000
+
+	modePassphrase byte = 1
+	modeX25519     byte = 2
+)
+
+// NewEncryptWriter returns a WriteCloser that encrypts everything written
+// to it onto w. Close must be called to write the final chunk; without it
+// the output will not decrypt.
+func NewEncryptWriter(w io.Writer, e Encryption) (io.WriteCloser, error) {
+	header := []byte(encryptionMagic)
+	var key []byte
+	switch {
+	case e.Passphrase != "" && e.Recipient != nil:
+		return nil, errors.New("encryption needs a Passphrase or a Recipient, not both")
+	case e.Passphrase != "":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		header = append(header, modePassphrase)
+		header = binary.BigEndian.AppendUint32(header, pbkdf2Iterations)
+		header = append(header, salt...)
+		var err error
+		if key, err = passphraseKey(e.Passphrase, salt, pbkdf2Iterations); err != nil {
+			return nil, err
+		}
+	case e.Recipient != nil:
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(e.Recipient)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, modeX25519)
+		header = append(header, ephemeral.PublicKey().Bytes()...)
+		if key, err = x25519Key(shared, ephemeral.PublicKey().Bytes(), e.Recipient.Bytes()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("encryption needs a Passphrase or a Recipient")
+	}
+
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, header: header}, nil
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	header []byte // authenticated with every chunk
+	buf    []byte
+	chunk  uint32
+	closed bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	e.buf = append(e.buf, p...)
+	// hold back up to a chunk so Close always has a last one to seal
+	for len(e.buf) > encryptionChunkSize {
+		if err := e.seal(e.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptionChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close seals and writes the last chunk. It doesn't close the underlying
+// writer.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(plaintext []byte, last bool) error {
+	if e.chunk == ^uint32(0) {
+		return errors.New("encrypted output is too long")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.chunk, last), plaintext, e.header)
+	e.chunk++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// NewDecryptReader returns a Reader of the plaintext encrypted onto r by
+// NewEncryptWriter. Reads return ErrDecrypt if the data was altered or
+// cut short.
+func NewDecryptReader(r io.Reader, e Encryption) (io.Reader, error) {
+	header := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not sqltocsv encrypted output")
+	}
+
+	var key []byte
+	switch header[len(encryptionMagic)] {
+	case modePassphrase:
+		if e.Passphrase == "" {
+			return nil, errors.New("output is encrypted with a passphrase")
+		}
+		params := make([]byte, 4+16)
+		if _, err := io.ReadFull(r, params); err != nil {
+			return nil, fmt.Errorf("reading encryption header: %w", err)
+		}
+		header = append(header, params...)
+		iterations := binary.BigEndian.Uint32(params)
+		if iterations == 0 || iterations > 100*pbkdf2Iterations {
+			return nil, fmt.Errorf("unreasonable PBKDF2 iteration count %d", iterations)
+		}
+		var err error
+		if key, err = passphraseKey(e.Passphrase, params[4:], int(iterations)); err != nil {
+			return nil, err
+		}
+	case modeX25519:
+		if e.Identity == nil {
+			return nil, errors.New("output is encrypted to an X25519 recipient")
+		}
+		ephemeralBytes := make([]byte, 32)
+		if _, err := io.ReadFull(r, ephemeralBytes); err != nil {
+			return nil, fmt.Errorf("reading encryption header: %w", err)
+		}
+		header = append(header, ephemeralBytes...)
+		ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := e.Identity.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = x25519Key(shared, ephemeralBytes, e.Identity.PublicKey().Bytes()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown encryption mode")
+	}
+
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	header = append(header, prefix...)
+
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, prefix: prefix, header: header}, nil
+}
+
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	header []byte
+	chunk  uint32
+	sealed []byte // the next sealed chunk, read ahead to spot the last one
+	plain  []byte
+	done   bool
+	err    error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next opens the next chunk. A chunk is the last one when it is short or
+// nothing follows it, and only a chunk sealed as last will open as last.
+func (d *decryptReader) next() error {
+	size := encryptionChunkSize + d.aead.Overhead()
+	if d.sealed == nil {
+		d.sealed = make([]byte, size+1)
+		n, err := io.ReadFull(d.r, d.sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return ErrDecrypt
+			}
+			return err
+		}
+		d.sealed = d.sealed[:n]
+	}
+
+	current := d.sealed
+	last := len(current) <= size
+	if !last {
+		// carry the read-ahead byte over to the next chunk
+		d.sealed = make([]byte, size+1)
+		d.sealed[0] = current[size]
+		n, err := io.ReadFull(d.r, d.sealed[1:])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		d.sealed = d.sealed[:n+1]
+		current = current[:size]
+	}
+
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.chunk, last), current, d.header)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.chunk++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func newChunkAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce prefix, the big endian chunk counter and a byte
+// that is 1 only for the last chunk.
+func chunkNonce(prefix []byte, chunk uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, chunk)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// x25519Key derives the AES key from an X25519 shared secret with
+// HKDF-SHA256, binding in both public keys.
+func x25519Key(shared, ephemeral, recipient []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, shared, bytes.Join([][]byte{ephemeral, recipient}, nil), "sqltocsv X25519", 32)
+}
+
+// passphraseKey derives the AES key from a passphrase with PBKDF2-SHA256.
+func passphraseKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+}
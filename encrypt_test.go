@@ -0,0 +1,180 @@
+package sqltocsv_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestEncryptionToRecipient(t *testing.T) {
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converter := getConverter(t)
+	converter.Encryption = &sqltocsv.Encryption{Recipient: identity.PublicKey()}
+
+	encrypted, err := converter.WriteString()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if strings.Contains(encrypted, "Alice") {
+		t.Error("expected the output to be encrypted")
+	}
+
+	expected := "name,age,bdate\nAlice,1,1973-11-29 21:33:09 +0000 UTC\n"
+	assertCsvMatch(t, expected, decrypt(t, []byte(encrypted), sqltocsv.Encryption{Identity: identity}))
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := decryptErr([]byte(encrypted), sqltocsv.Encryption{Identity: other}); err != sqltocsv.ErrDecrypt {
+		t.Errorf("expected ErrDecrypt with the wrong identity, got %v", err)
+	}
+}
+
+func TestEncryptionWithPassphrase(t *testing.T) {
+	converter := getConverter(t)
+	converter.Encryption = &sqltocsv.Encryption{Passphrase: "correct horse"}
+
+	encrypted, err := converter.WriteString()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "name,age,bdate\nAlice,1,1973-11-29 21:33:09 +0000 UTC\n"
+	assertCsvMatch(t, expected, decrypt(t, []byte(encrypted), sqltocsv.Encryption{Passphrase: "correct horse"}))
+
+	if _, err := decryptErr([]byte(encrypted), sqltocsv.Encryption{Passphrase: "battery staple"}); err != sqltocsv.ErrDecrypt {
+		t.Errorf("expected ErrDecrypt with the wrong passphrase, got %v", err)
+	}
+}
+
+// TestEncryptionDecryptsEarlierOutput decrypts output written by an
+// earlier version, so changes to the key derivation can't go unnoticed.
+func TestEncryptionDecryptsEarlierOutput(t *testing.T) {
+	identity, err := ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name      string
+		encrypted string
+		e         sqltocsv.Encryption
+	}{
+		{"passphrase", "73716c746f63737600656e633101000927c0232848b4071c7549b769144918c4b1b5f714b3c08530b41f6d0e3d6ecaf99288e32a9cb1d9f4e8d057308df682b72dfc88c258777e12ad67", sqltocsv.Encryption{Passphrase: "correct horse"}},
+		{"X25519", "73716c746f63737600656e633102b4e884ff370e1be251514c651f157caa723372e6e581ba055d3a7670f1b8d2659c415535ff63a7193038fe5d8f2892cb409dd98f5b25f9e88feb8276bf6d79d4637a5c1a42adf9c3", sqltocsv.Encryption{Identity: identity}},
+	} {
+		encrypted, _ := hex.DecodeString(test.encrypted)
+		if actual, err := decryptErr(encrypted, test.e); err != nil || actual != "name,age\nAlice,1\n" {
+			t.Errorf("%s: expected the CSV, got %q and %v", test.name, actual, err)
+		}
+	}
+}
+
+func TestEncryptionDetectsTamperingAndTruncation(t *testing.T) {
+	identity, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	e := sqltocsv.Encryption{Recipient: identity.PublicKey(), Identity: identity}
+
+	// a few chunks' worth, ending part way through a chunk
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 64*1024/16*3+5)
+	buffer := bytes.Buffer{}
+	w, err := sqltocsv.NewEncryptWriter(&buffer, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(plaintext)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buffer.Bytes()
+
+	if decrypted := decrypt(t, encrypted, e); decrypted != string(plaintext) {
+		t.Fatal("round trip didn't give back the plaintext")
+	}
+
+	headerSize := len("sqltocsv\x00enc1") + 1 + 32 + 7
+	sealedChunk := 64*1024 + 16
+	cases := map[string][]byte{
+		"flipped bit":         flipBit(encrypted, headerSize+100),
+		"flipped header bit":  flipBit(encrypted, headerSize-1),
+		"truncated mid chunk": encrypted[:len(encrypted)-10],
+		"truncated at chunk":  encrypted[:headerSize+2*sealedChunk],
+		"last chunk dropped":  encrypted[:headerSize+3*sealedChunk],
+		"only header":         encrypted[:headerSize],
+		"chunks swapped":      swapChunks(encrypted, headerSize, sealedChunk),
+		"trailing bytes":      append(append([]byte(nil), encrypted...), 0),
+	}
+	for name, tampered := range cases {
+		if _, err := decryptErr(tampered, e); err != sqltocsv.ErrDecrypt {
+			t.Errorf("%s: expected ErrDecrypt, got %v", name, err)
+		}
+	}
+}
+
+func TestEncryptionEmptyAndExactChunk(t *testing.T) {
+	e := sqltocsv.Encryption{Passphrase: "p"}
+	for _, size := range []int{0, 64 * 1024} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		buffer := bytes.Buffer{}
+		w, err := sqltocsv.NewEncryptWriter(&buffer, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plaintext)
+		w.Close()
+
+		if decrypted := decrypt(t, buffer.Bytes(), e); decrypted != string(plaintext) {
+			t.Errorf("round trip of %d bytes gave back %d bytes", size, len(decrypted))
+		}
+	}
+}
+
+func TestEncryptionFailedWriteDoesNotDecrypt(t *testing.T) {
+	identity, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	converter := getConverter(t)
+	converter.Columns = []string{"nope"}
+	converter.Encryption = &sqltocsv.Encryption{Recipient: identity.PublicKey()}
+
+	encrypted, err := converter.WriteString()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := decryptErr([]byte(encrypted), sqltocsv.Encryption{Identity: identity}); err != sqltocsv.ErrDecrypt {
+		t.Errorf("expected the unfinished output not to decrypt, got %v", err)
+	}
+}
+
+func decrypt(t *testing.T, encrypted []byte, e sqltocsv.Encryption) string {
+	decrypted, err := decryptErr(encrypted, e)
+	if err != nil {
+		t.Fatalf("unexpected error decrypting %v", err)
+	}
+	return decrypted
+}
+
+func decryptErr(encrypted []byte, e sqltocsv.Encryption) (string, error) {
+	r, err := sqltocsv.NewDecryptReader(bytes.NewReader(encrypted), e)
+	if err != nil {
+		return "", err
+	}
+	decrypted, err := io.ReadAll(r)
+	return string(decrypted), err
+}
+
+func flipBit(data []byte, i int) []byte {
+	flipped := append([]byte(nil), data...)
+	flipped[i] ^= 1
+	return flipped
+}
+
+func swapChunks(data []byte, offset, size int) []byte {
+	swapped := append([]byte(nil), data...)
+	copy(swapped[offset:], data[offset+size:offset+2*size])
+	copy(swapped[offset+size:], data[offset:offset+size])
+	return swapped
+}
@@ -0,0 +1,74 @@
+package sqltocsv
+
+import "strings"
+
+// utf8BOM is written at the start of ExcelSafe output so Excel detects
+// the file as UTF-8 rather than the local ANSI code page. Other encodings
+// get their own BOM, see byteOrderMark.
+const utf8BOM = "\xEF\xBB\xBF"
+
+// excelFormulaPrefixes are the leading characters that cause a spreadsheet
+// to treat a cell as a formula, as listed in the OWASP CSV injection guidance.
+const excelFormulaPrefixes = "=+-@\t\r"
+
+// excelSafeValue neutralises a single cell for Excel. Values that would be
+// interpreted as formulas are prefixed with a single quote, and when
+// preserveZeros is set, numeric strings with a leading zero are wrapped
+// as ="00123" so Excel doesn't strip the zeros on open.
+func excelSafeValue(value string, preserveZeros bool) string {
+	if value == "" {
+		return value
+	}
+
+	if isNumeric(value) {
+		if preserveZeros && hasLeadingZero(value) {
+			return `="` + value + `"`
+		}
+		// plain numbers (including negatives) can't carry a formula
+		return value
+	}
+
+	if strings.IndexByte(excelFormulaPrefixes, value[0]) >= 0 {
+		return "'" + value
+	}
+
+	return value
+}
+
+// excelSafeRow applies excelSafeValue to every cell in row except those in
+// columns named in ExcelSafeExempt. The row is modified in place.
+func (c *Converter) excelSafeRow(row []string, columnNames []string) []string {
+	for i := range row {
+		if i < len(columnNames) && contains(c.ExcelSafeExempt, columnNames[i]) {
+			continue
+		}
+		row[i] = excelSafeValue(row[i], c.PreserveLeadingZeros)
+	}
+	return row
+}
+
+// isNumeric reports whether value is a plain decimal number such as 42,
+// -3.5 or 00123. Anything fancier (exponents, a leading +, Inf) is treated
+// as text so it gets the formula checks.
+func isNumeric(value string) bool {
+	digits := strings.TrimPrefix(value, "-")
+	if digits == "" {
+		return false
+	}
+	seenDot := false
+	for i, r := range digits {
+		switch {
+		case r >= '0' && r <= '9':
+		case r == '.' && !seenDot && i > 0 && i < len(digits)-1:
+			seenDot = true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func hasLeadingZero(value string) bool {
+	digits := strings.TrimPrefix(value, "-")
+	return len(digits) > 1 && digits[0] == '0' && digits[1] != '.'
+}
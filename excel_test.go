@@ -0,0 +1,73 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestExcelSafeWritesBOM(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.ExcelSafe = true
+
+	expected := "\xEF\xBB\xBFname,age,bdate\nAlice,1,1973-11-29 21:33:09 +0000 UTC\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestExcelSafeEscapesFormulas(t *testing.T) {
+	converter := sqltocsv.New(getExcelTestRows(t))
+
+	converter.ExcelSafe = true
+
+	expected := "\xEF\xBB\xBFcode,formula,amount\n" +
+		"00123,\"'=HYPERLINK(\"\"http://evil\"\")\",-12.5\n" +
+		"0042,'@SUM(A1:A2),'+1\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestExcelSafePreserveLeadingZeros(t *testing.T) {
+	converter := sqltocsv.New(getExcelTestRows(t))
+
+	converter.ExcelSafe = true
+	converter.PreserveLeadingZeros = true
+
+	expected := "\xEF\xBB\xBFcode,formula,amount\n" +
+		"\"=\"\"00123\"\"\",\"'=HYPERLINK(\"\"http://evil\"\")\",-12.5\n" +
+		"\"=\"\"0042\"\"\",'@SUM(A1:A2),'+1\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestExcelSafeExemptColumns(t *testing.T) {
+	converter := sqltocsv.New(getExcelTestRows(t))
+
+	converter.ExcelSafe = true
+	converter.ExcelSafeExempt = []string{"formula"}
+
+	expected := "\xEF\xBB\xBFcode,formula,amount\n" +
+		"00123,\"=HYPERLINK(\"\"http://evil\"\")\",-12.5\n" +
+		"0042,@SUM(A1:A2),'+1\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func getExcelTestRows(t *testing.T) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|cells|code=string,formula=string,amount=string")
+	exec(t, db, "INSERT|cells|code=?,formula=?,amount=?", "00123", `=HYPERLINK("http://evil")`, "-12.5")
+	exec(t, db, "INSERT|cells|code=?,formula=?,amount=?", "0042", "@SUM(A1:A2)", "+1")
+
+	rows, err := db.Query("SELECT|cells|code,formula,amount|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
@@ -0,0 +1,1091 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file holds the small SQL-like expression language used by computed
+// columns. Expressions are compiled once against the query's column types,
+// so type errors are reported before the first row, then evaluated against
+// the raw values scanned from each row.
+//
+// At runtime a value is always one of nil, int64, float64, string, bool or
+// time.Time.
+
+// valueKind is the static type of an expression.
+type valueKind int
+
+const (
+	kindAny valueKind = iota // only known once a row is read
+	kindNull
+	kindNumber
+	kindString
+	kindBool
+	kindTime
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindNull:
+		return "null"
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindBool:
+		return "boolean"
+	case kindTime:
+		return "time"
+	}
+	return "any"
+}
+
+// accepts reports whether a value of kind other can be used where k is
+// expected. Anything goes when either side is only known at runtime.
+func (k valueKind) accepts(other valueKind) bool {
+	return k == other || k == kindAny || other == kindAny || other == kindNull
+}
+
+// exprColumn is a column an expression can refer to.
+type exprColumn struct {
+	name       string
+	kind       valueKind
+	restricted bool // by a Policy, so it can't be read
+}
+
+// exprColumns describes the query's columns for the expression compiler,
+// using the database type names where the driver reports them.
+func exprColumns(rows *sql.Rows, columnNames []string) []exprColumn {
+	columns := make([]exprColumn, len(columnNames))
+	columnTypes, err := rows.ColumnTypes()
+	for i, name := range columnNames {
+		columns[i].name = name
+		if err == nil && i < len(columnTypes) {
+			columns[i].kind = exprKindOf(columnTypes[i])
+		}
+	}
+	return columns
+}
+
+// integerTypes are the database type names of integer columns.
+var integerTypes = map[string]bool{
+	"INT": true, "INTEGER": true, "TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "BIGINT": true,
+	"INT2": true, "INT4": true, "INT8": true, "INT16": true, "INT32": true, "INT64": true,
+	"SERIAL": true, "BIGSERIAL": true,
+}
+
+// databaseTypeName is the column's type name upper cased, without any
+// UNSIGNED.
+func databaseTypeName(columnType *sql.ColumnType) string {
+	return strings.TrimPrefix(strings.ToUpper(columnType.DatabaseTypeName()), "UNSIGNED ")
+}
+
+func exprKindOf(columnType *sql.ColumnType) valueKind {
+	typeName := databaseTypeName(columnType)
+	if integerTypes[typeName] {
+		return kindNumber
+	}
+	switch typeName {
+	case "NUMERIC", "DECIMAL", "NUMBER", "MONEY", "REAL", "DOUBLE", "DOUBLE PRECISION",
+		"FLOAT", "FLOAT4", "FLOAT8", "FLOAT32", "FLOAT64":
+		return kindNumber
+	case "CHAR", "VARCHAR", "NCHAR", "NVARCHAR", "BPCHAR", "TEXT", "TINYTEXT",
+		"MEDIUMTEXT", "LONGTEXT", "NTEXT", "CITEXT", "CLOB":
+		return kindString
+	case "DATE", "TIME", "TIMETZ", "DATETIME", "DATETIME2", "SMALLDATETIME",
+		"TIMESTAMP", "TIMESTAMPTZ":
+		return kindTime
+	case "BOOL", "BOOLEAN":
+		return kindBool
+	}
+
+	scanType := columnType.ScanType()
+	if scanType == nil {
+		return kindAny
+	}
+	switch reflect.Zero(scanType).Interface().(type) {
+	case sql.NullInt64, sql.NullInt32, sql.NullInt16, sql.NullFloat64, sql.NullByte:
+		return kindNumber
+	case sql.NullString:
+		return kindString
+	case sql.NullBool:
+		return kindBool
+	case sql.NullTime, time.Time:
+		return kindTime
+	}
+	switch scanType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return kindNumber
+	case reflect.String:
+		return kindString
+	case reflect.Bool:
+		return kindBool
+	}
+	return kindAny
+}
+
+// expr is a compiled expression.
+type expr interface {
+	kind() valueKind
+	eval(row []interface{}) (interface{}, error)
+}
+
+// compileExpr parses source and type checks it against columns.
+func compileExpr(source string, columns []exprColumn) (expr, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, columns: columns}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	return e, nil
+}
+
+// Lexing
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenQuotedIdent
+	tokenOp
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	pos  int
+}
+
+// operators longest first so <= wins over <
+var operators = []string{"<=", ">=", "<>", "!=", "||", "=", "<", ">", "~", "+", "-", "*", "/", "%", "(", ")", ","}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		ch := rune(source[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch >= '0' && ch <= '9' || ch == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, source[start:i], start})
+		case ch == '\'' || ch == '"':
+			start := i
+			text, end, err := lexQuoted(source, i)
+			if err != nil {
+				return nil, err
+			}
+			typ := tokenString
+			if ch == '"' {
+				typ = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{typ, text, start})
+			i = end
+		case ch == '_' || ch >= 0x80 || unicode.IsLetter(ch):
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 0x80 ||
+				unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, source[start:i], start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{tokenOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at position %d", ch, i)
+			}
+		}
+	}
+	return append(tokens, token{typ: tokenEOF, pos: len(source)}), nil
+}
+
+// lexQuoted reads a quoted string or identifier starting at source[start],
+// where a doubled quote stands for a literal one as in SQL.
+func lexQuoted(source string, start int) (string, int, error) {
+	quote := source[start]
+	var text strings.Builder
+	for i := start + 1; i < len(source); i++ {
+		if source[i] != quote {
+			text.WriteByte(source[i])
+			continue
+		}
+		if i+1 < len(source) && source[i+1] == quote {
+			text.WriteByte(quote)
+			i++
+			continue
+		}
+		return text.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated %c at position %d", quote, start)
+}
+
+// Parsing
+
+type parser struct {
+	tokens  []token
+	pos     int
+	columns []exprColumn
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword reports whether t is the (case insensitive) keyword word.
+func (t token) isKeyword(word string) bool {
+	return t.typ == tokenIdent && strings.EqualFold(t.text, word)
+}
+
+func (t token) isOp(op string) bool {
+	return t.typ == tokenOp && t.text == op
+}
+
+func (p *parser) expectOp(op string) error {
+	if t := p.next(); !t.isOp(op) {
+		return fmt.Errorf("expected %q at position %d", op, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newLogical("OR", left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newLogical("AND", left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if !p.peek().isKeyword("NOT") {
+		return p.parseComparison()
+	}
+	p.next()
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if !kindBool.accepts(operand.kind()) {
+		return nil, fmt.Errorf("NOT needs a boolean, got %s", operand.kind())
+	}
+	return &notExpr{operand}, nil
+}
+
+var comparisonOps = map[string]bool{"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.isKeyword("IS"):
+		return p.parseIsNull(left)
+	case t.isKeyword("NOT"):
+		// NOT IN, NOT LIKE and friends; a bare NOT here is a syntax error
+		p.next()
+		return p.parsePredicate(left, true)
+	case t.isKeyword("IN") || t.isKeyword("LIKE") || t.isKeyword("ILIKE") || t.isKeyword("REGEXP") || t.isOp("~"):
+		return p.parsePredicate(left, false)
+	case t.typ != tokenOp || !comparisonOps[t.text]:
+		return left, nil
+	}
+
+	p.next()
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return newComparison(t.text, left, right)
+}
+
+// parseIsNull parses IS NULL or IS NOT NULL after left.
+func (p *parser) parseIsNull(left expr) (expr, error) {
+	p.next() // IS
+	negate := false
+	if p.peek().isKeyword("NOT") {
+		p.next()
+		negate = true
+	}
+	if t := p.next(); !t.isKeyword("NULL") {
+		return nil, fmt.Errorf("expected NULL at position %d", t.pos)
+	}
+	return &isNullExpr{left, negate}, nil
+}
+
+// parsePredicate parses IN (...), LIKE, ILIKE, REGEXP or ~ after left,
+// with any leading NOT already consumed.
+func (p *parser) parsePredicate(left expr, negate bool) (expr, error) {
+	t := p.next()
+	if t.isKeyword("IN") {
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		var list []expr
+		for {
+			item, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			if !comparable(left.kind(), item.kind()) {
+				return nil, fmt.Errorf("can't compare %s IN %s", left.kind(), item.kind())
+			}
+			list = append(list, item)
+			if !p.peek().isOp(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return &inExpr{left, list, negate}, nil
+	}
+
+	var kind matchKind
+	switch {
+	case t.isKeyword("LIKE"):
+		kind = matchLike
+	case t.isKeyword("ILIKE"):
+		kind = matchILike
+	case t.isKeyword("REGEXP") || t.isOp("~"):
+		kind = matchRegexp
+	default:
+		return nil, fmt.Errorf("expected IN, LIKE, ILIKE or REGEXP at position %d", t.pos)
+	}
+	pattern, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return newMatch(kind, left, pattern, negate)
+}
+
+func (p *parser) parseAdditive() (expr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.isOp("+") || t.isOp("-") || t.isOp("||"); t = p.peek() {
+		p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "||" {
+			left = &concatExpr{left, right}
+		} else if left, err = newArithmetic(t.text, left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseMultiplicative() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.isOp("*") || t.isOp("/") || t.isOp("%"); t = p.peek() {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = newArithmetic(t.text, left, right); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if !p.peek().isOp("-") {
+		return p.parsePrimary()
+	}
+	p.next()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return newArithmetic("-", &literal{int64(0)}, operand)
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch {
+	case t.typ == tokenNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &literal{n}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at position %d", t.text, t.pos)
+		}
+		return &literal{f}, nil
+	case t.typ == tokenString:
+		return &literal{t.text}, nil
+	case t.isOp("("):
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectOp(")")
+	case t.isKeyword("NULL"):
+		return &literal{nil}, nil
+	case t.isKeyword("TRUE"):
+		return &literal{true}, nil
+	case t.isKeyword("FALSE"):
+		return &literal{false}, nil
+	case t.typ == tokenIdent && p.peek().isOp("("):
+		return p.parseCall(t)
+	case t.typ == tokenIdent || t.typ == tokenQuotedIdent:
+		for i, column := range p.columns {
+			if column.name == t.text {
+				if column.restricted {
+					return nil, fmt.Errorf("the policy doesn't allow reading column %q at position %d", t.text, t.pos)
+				}
+				return &columnRef{index: i, column: column}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown column %q at position %d", t.text, t.pos)
+	case t.typ == tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseCall(name token) (expr, error) {
+	p.next() // (
+	var args []expr
+	if !p.peek().isOp(")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.peek().isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	return newCall(strings.ToLower(name.text), args)
+}
+
+// Expression nodes
+
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) kind() valueKind {
+	return kindOfValue(l.value)
+}
+
+func (l *literal) eval(row []interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+type columnRef struct {
+	index  int
+	column exprColumn
+}
+
+func (c *columnRef) kind() valueKind {
+	return c.column.kind
+}
+
+func (c *columnRef) eval(row []interface{}) (interface{}, error) {
+	value, err := normalizeValue(row[c.index], c.column.kind)
+	if err != nil {
+		return nil, fmt.Errorf("column %q: %w", c.column.name, err)
+	}
+	return value, nil
+}
+
+type arithmeticExpr struct {
+	op          string
+	left, right expr
+}
+
+func newArithmetic(op string, left, right expr) (expr, error) {
+	for _, operand := range []expr{left, right} {
+		if !kindNumber.accepts(operand.kind()) {
+			return nil, fmt.Errorf("%s needs numbers, got %s", op, operand.kind())
+		}
+	}
+	return &arithmeticExpr{op, left, right}, nil
+}
+
+func (a *arithmeticExpr) kind() valueKind {
+	return kindNumber
+}
+
+func (a *arithmeticExpr) eval(row []interface{}) (interface{}, error) {
+	left, right, err := evalPair(a.left, a.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+
+	li, lInt := left.(int64)
+	ri, rInt := right.(int64)
+	if lInt && rInt {
+		switch a.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "%":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return li % ri, nil
+		case "/":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if li%ri == 0 {
+				return li / ri, nil
+			}
+		}
+	}
+
+	lf, err := toFloat(left)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toFloat(right)
+	if err != nil {
+		return nil, err
+	}
+	switch a.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	}
+	if rf == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if a.op == "%" {
+		return math.Mod(lf, rf), nil
+	}
+	return lf / rf, nil
+}
+
+type concatExpr struct {
+	left, right expr
+}
+
+func (c *concatExpr) kind() valueKind {
+	return kindString
+}
+
+func (c *concatExpr) eval(row []interface{}) (interface{}, error) {
+	left, right, err := evalPair(c.left, c.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+	return toString(left) + toString(right), nil
+}
+
+type comparisonExpr struct {
+	op          string
+	left, right expr
+}
+
+func newComparison(op string, left, right expr) (expr, error) {
+	if !comparable(left.kind(), right.kind()) {
+		return nil, fmt.Errorf("can't compare %s %s %s", left.kind(), op, right.kind())
+	}
+	return &comparisonExpr{op, left, right}, nil
+}
+
+// comparable reports whether values of two kinds can be compared. Times
+// compare against strings so filters can say bdate > '2020-01-01'.
+func comparable(a, b valueKind) bool {
+	if a.accepts(b) || b.accepts(a) {
+		return true
+	}
+	return a == kindTime && b == kindString || a == kindString && b == kindTime
+}
+
+func (c *comparisonExpr) kind() valueKind {
+	return kindBool
+}
+
+func (c *comparisonExpr) eval(row []interface{}) (interface{}, error) {
+	left, right, err := evalPair(c.left, c.right, row)
+	if err != nil || left == nil || right == nil {
+		return nil, err
+	}
+	order, err := compareValues(left, right)
+	if err != nil {
+		return nil, err
+	}
+	switch c.op {
+	case "=":
+		return order == 0, nil
+	case "!=", "<>":
+		return order != 0, nil
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+// logicalExpr is AND or OR with SQL's three valued logic: NULL AND FALSE
+// is FALSE but NULL AND TRUE is NULL.
+type logicalExpr struct {
+	op          string
+	left, right expr
+}
+
+func newLogical(op string, left, right expr) (expr, error) {
+	for _, operand := range []expr{left, right} {
+		if !kindBool.accepts(operand.kind()) {
+			return nil, fmt.Errorf("%s needs booleans, got %s", op, operand.kind())
+		}
+	}
+	return &logicalExpr{op, left, right}, nil
+}
+
+func (l *logicalExpr) kind() valueKind {
+	return kindBool
+}
+
+func (l *logicalExpr) eval(row []interface{}) (interface{}, error) {
+	decisive := l.op == "OR" // the value that settles the result on its own
+	sawNull := false
+	for _, operand := range []expr{l.left, l.right} {
+		value, err := operand.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			sawNull = true
+			continue
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", l.op, kindOfValue(value))
+		}
+		if b == decisive {
+			return decisive, nil
+		}
+	}
+	if sawNull {
+		return nil, nil
+	}
+	return !decisive, nil
+}
+
+type notExpr struct {
+	operand expr
+}
+
+func (n *notExpr) kind() valueKind {
+	return kindBool
+}
+
+func (n *notExpr) eval(row []interface{}) (interface{}, error) {
+	value, err := n.operand.eval(row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("NOT needs a boolean, got %s", kindOfValue(value))
+	}
+	return !b, nil
+}
+
+type isNullExpr struct {
+	operand expr
+	negate  bool
+}
+
+func (i *isNullExpr) kind() valueKind {
+	return kindBool
+}
+
+func (i *isNullExpr) eval(row []interface{}) (interface{}, error) {
+	value, err := i.operand.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	return (value == nil) != i.negate, nil
+}
+
+// inExpr is x IN (a, b, ...). Like SQL it is NULL rather than false when x
+// is NULL, or when nothing matches and the list holds a NULL.
+type inExpr struct {
+	operand expr
+	list    []expr
+	negate  bool
+}
+
+func (i *inExpr) kind() valueKind {
+	return kindBool
+}
+
+func (i *inExpr) eval(row []interface{}) (interface{}, error) {
+	value, err := i.operand.eval(row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	sawNull := false
+	for _, item := range i.list {
+		candidate, err := item.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if candidate == nil {
+			sawNull = true
+			continue
+		}
+		order, err := compareValues(value, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if order == 0 {
+			return !i.negate, nil
+		}
+	}
+	if sawNull {
+		return nil, nil
+	}
+	return i.negate, nil
+}
+
+type matchKind int
+
+const (
+	matchLike matchKind = iota
+	matchILike
+	matchRegexp
+)
+
+// matchExpr is LIKE, ILIKE or a regular expression match. Literal patterns
+// are compiled once up front; anything else is compiled per row.
+type matchExpr struct {
+	mode     matchKind
+	operand  expr
+	pattern  expr
+	compiled *regexp.Regexp
+	negate   bool
+}
+
+func newMatch(kind matchKind, operand, pattern expr, negate bool) (expr, error) {
+	for _, e := range []expr{operand, pattern} {
+		if !kindString.accepts(e.kind()) {
+			return nil, fmt.Errorf("pattern matching needs strings, got %s", e.kind())
+		}
+	}
+	m := &matchExpr{mode: kind, operand: operand, pattern: pattern, negate: negate}
+	if l, ok := pattern.(*literal); ok && l.value != nil {
+		compiled, err := m.compile(l.value.(string))
+		if err != nil {
+			return nil, err
+		}
+		m.compiled = compiled
+	}
+	return m, nil
+}
+
+// compile turns a LIKE pattern, where % is any run of characters and _ is
+// any one character, or a regular expression into a Regexp.
+func (m *matchExpr) compile(pattern string) (*regexp.Regexp, error) {
+	if m.mode == matchRegexp {
+		return regexp.Compile(pattern)
+	}
+	var b strings.Builder
+	if m.mode == matchILike {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile("(?s)" + b.String())
+}
+
+func (m *matchExpr) kind() valueKind {
+	return kindBool
+}
+
+func (m *matchExpr) eval(row []interface{}) (interface{}, error) {
+	value, err := m.operand.eval(row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	compiled := m.compiled
+	if compiled == nil {
+		pattern, err := m.pattern.eval(row)
+		if err != nil || pattern == nil {
+			return nil, err
+		}
+		if compiled, err = m.compile(toString(pattern)); err != nil {
+			return nil, err
+		}
+	}
+	return compiled.MatchString(toString(value)) != m.negate, nil
+}
+
+func evalPair(left, right expr, row []interface{}) (interface{}, interface{}, error) {
+	l, err := left.eval(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := right.eval(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, r, nil
+}
+
+// Runtime values
+
+func kindOfValue(value interface{}) valueKind {
+	switch value.(type) {
+	case nil:
+		return kindNull
+	case int64, float64:
+		return kindNumber
+	case string:
+		return kindString
+	case bool:
+		return kindBool
+	case time.Time:
+		return kindTime
+	}
+	return kindAny
+}
+
+// normalizeValue turns a value from rows.Scan into one of the runtime value
+// types, parsing text from numeric columns (which some drivers send for
+// DECIMAL) into a number.
+func normalizeValue(raw interface{}, kind valueKind) (interface{}, error) {
+	switch v := raw.(type) {
+	case nil, int64, float64, bool, time.Time:
+		return v, nil
+	case []byte:
+		return normalizeText(string(v), kind)
+	case string:
+		return normalizeText(v, kind)
+	case float32:
+		return float64(v), nil
+	}
+
+	rv := reflect.ValueOf(raw)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	}
+	return fmt.Sprintf("%v", raw), nil
+}
+
+func normalizeText(s string, kind valueKind) (interface{}, error) {
+	if kind != kindNumber {
+		return s, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", s)
+	}
+	return f, nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %s %q", kindOfValue(value), toString(value))
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// timeLayouts are tried in order when a string is compared with a time.
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date or time", s)
+}
+
+// compareValues orders two non-nil values, returning -1, 0 or 1.
+func compareValues(a, b interface{}) (int, error) {
+	if at, ok := a.(time.Time); ok {
+		if bs, ok := b.(string); ok {
+			bt, err := parseTime(bs)
+			if err != nil {
+				return 0, err
+			}
+			b = bt
+		}
+		if bt, ok := b.(time.Time); ok {
+			switch {
+			case at.Before(bt):
+				return -1, nil
+			case at.After(bt):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if _, ok := b.(time.Time); ok {
+		order, err := compareValues(b, a)
+		return -order, err
+	}
+
+	switch av := a.(type) {
+	case int64, float64:
+		if ai, ok := av.(int64); ok {
+			// compared exactly, as float64 can't tell big integers apart
+			if bi, ok := b.(int64); ok {
+				return compareOrdered(ai > bi, ai < bi), nil
+			}
+		}
+		af, _ := toFloat(av)
+		bf, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case af < bf:
+			return -1, nil
+		case af > bf:
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if bs, ok := b.(string); ok {
+			return strings.Compare(av, bs), nil
+		}
+	case bool:
+		if bb, ok := b.(bool); ok {
+			return boolRank(av) - boolRank(bb), nil
+		}
+	}
+	return 0, fmt.Errorf("can't compare %s with %s", kindOfValue(a), kindOfValue(b))
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
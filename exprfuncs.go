@@ -0,0 +1,408 @@
+package sqltocsv
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// function is a built in function callable from an expression.
+type function struct {
+	params   []valueKind // kind of each parameter, kindAny takes anything
+	optional int         // how many trailing params can be left out
+	variadic bool        // the last param can repeat
+	nullSafe bool        // call with NULL arguments rather than returning NULL
+	result   valueKind
+	call     func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]*function{
+	// strings
+	"upper":   {params: kinds(kindString), result: kindString, call: stringFunc(strings.ToUpper)},
+	"lower":   {params: kinds(kindString), result: kindString, call: stringFunc(strings.ToLower)},
+	"trim":    {params: kinds(kindString), result: kindString, call: stringFunc(strings.TrimSpace)},
+	"length":  {params: kinds(kindString), result: kindNumber, call: fnLength},
+	"substr":  {params: kinds(kindString, kindNumber, kindNumber), optional: 1, result: kindString, call: fnSubstr},
+	"left":    {params: kinds(kindString, kindNumber), result: kindString, call: fnLeft},
+	"right":   {params: kinds(kindString, kindNumber), result: kindString, call: fnRight},
+	"replace": {params: kinds(kindString, kindString, kindString), result: kindString, call: fnReplace},
+	"concat":  {params: kinds(kindAny), variadic: true, nullSafe: true, result: kindString, call: fnConcat},
+
+	// numbers
+	"abs":   {params: kinds(kindNumber), result: kindNumber, call: fnAbs},
+	"round": {params: kinds(kindNumber, kindNumber), optional: 1, result: kindNumber, call: fnRound},
+	"floor": {params: kinds(kindNumber), result: kindNumber, call: floatFunc(math.Floor)},
+	"ceil":  {params: kinds(kindNumber), result: kindNumber, call: floatFunc(math.Ceil)},
+
+	// dates and times
+	"year":        {params: kinds(kindTime), result: kindNumber, call: timePart(func(t time.Time) int { return t.Year() })},
+	"month":       {params: kinds(kindTime), result: kindNumber, call: timePart(func(t time.Time) int { return int(t.Month()) })},
+	"day":         {params: kinds(kindTime), result: kindNumber, call: timePart(time.Time.Day)},
+	"hour":        {params: kinds(kindTime), result: kindNumber, call: timePart(time.Time.Hour)},
+	"minute":      {params: kinds(kindTime), result: kindNumber, call: timePart(time.Time.Minute)},
+	"date_format": {params: kinds(kindTime, kindString), result: kindString, call: fnDateFormat},
+	"date_add":    {params: kinds(kindTime, kindNumber), result: kindTime, call: fnDateAdd},
+	"date_diff":   {params: kinds(kindTime, kindTime), result: kindNumber, call: fnDateDiff},
+	"to_date":     {params: kinds(kindString, kindString), optional: 1, result: kindTime, call: fnToDate},
+	"now":         {result: kindTime, call: fnNow},
+
+	// conversions
+	"string": {params: kinds(kindAny), result: kindString, call: fnString},
+	"number": {params: kinds(kindAny), result: kindNumber, call: fnNumber},
+}
+
+func kinds(k ...valueKind) []valueKind {
+	return k
+}
+
+// newCall type checks a call to a built in function. if and coalesce are
+// handled separately as their result kind depends on their arguments.
+func newCall(name string, args []expr) (expr, error) {
+	switch name {
+	case "if":
+		return newIf(args)
+	case "coalesce":
+		return newCoalesce(args)
+	}
+
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+
+	minArgs, maxArgs := len(fn.params)-fn.optional, len(fn.params)
+	if fn.variadic {
+		maxArgs = -1
+	}
+	if len(args) < minArgs || maxArgs != -1 && len(args) > maxArgs {
+		return nil, fmt.Errorf("%s() takes %s, got %d", name, argCount(minArgs, maxArgs), len(args))
+	}
+	for i, arg := range args {
+		if want := fn.param(i); !want.accepts(arg.kind()) {
+			return nil, fmt.Errorf("argument %d of %s() must be a %s, got %s", i+1, name, want, arg.kind())
+		}
+	}
+	return &callExpr{name: name, fn: fn, args: args}, nil
+}
+
+func (fn *function) param(i int) valueKind {
+	if i >= len(fn.params) {
+		return fn.params[len(fn.params)-1]
+	}
+	return fn.params[i]
+}
+
+func argCount(min, max int) string {
+	switch {
+	case max == -1:
+		return fmt.Sprintf("at least %d arguments", min)
+	case min == max:
+		return fmt.Sprintf("%d arguments", min)
+	}
+	return fmt.Sprintf("%d to %d arguments", min, max)
+}
+
+type callExpr struct {
+	name string
+	fn   *function
+	args []expr
+}
+
+func (c *callExpr) kind() valueKind {
+	return c.fn.result
+}
+
+func (c *callExpr) eval(row []interface{}) (interface{}, error) {
+	values := make([]interface{}, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil && !c.fn.nullSafe {
+			return nil, nil
+		}
+		if values[i], err = coerce(value, c.fn.param(i)); err != nil {
+			return nil, fmt.Errorf("argument %d of %s(): %w", i+1, c.name, err)
+		}
+	}
+	return c.fn.call(values)
+}
+
+// coerce checks a runtime value against a parameter kind, converting text
+// for number and time parameters when the column type wasn't known.
+func coerce(value interface{}, kind valueKind) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch kind {
+	case kindString:
+		return toString(value), nil
+	case kindNumber:
+		if s, ok := value.(string); ok {
+			return normalizeText(s, kindNumber)
+		}
+	case kindTime:
+		if s, ok := value.(string); ok {
+			return parseTime(s)
+		}
+	}
+	if kind != kindAny && kindOfValue(value) != kind {
+		return nil, fmt.Errorf("expected a %s, got %s", kind, kindOfValue(value))
+	}
+	return value, nil
+}
+
+// ifExpr is if(condition, then, else).
+type ifExpr struct {
+	condition, then, otherwise expr
+	result                     valueKind
+}
+
+func newIf(args []expr) (expr, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("if() takes 3 arguments, got %d", len(args))
+	}
+	if !kindBool.accepts(args[0].kind()) {
+		return nil, fmt.Errorf("argument 1 of if() must be a boolean, got %s", args[0].kind())
+	}
+	result, err := commonKind("if()", args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &ifExpr{args[0], args[1], args[2], result}, nil
+}
+
+func (i *ifExpr) kind() valueKind {
+	return i.result
+}
+
+func (i *ifExpr) eval(row []interface{}) (interface{}, error) {
+	condition, err := i.condition.eval(row)
+	if err != nil {
+		return nil, err
+	}
+	if condition == true {
+		return i.then.eval(row)
+	}
+	return i.otherwise.eval(row)
+}
+
+// coalesceExpr is coalesce(a, b, ...), the first argument that isn't NULL.
+type coalesceExpr struct {
+	args   []expr
+	result valueKind
+}
+
+func newCoalesce(args []expr) (expr, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("coalesce() takes at least 1 argument")
+	}
+	result, err := commonKind("coalesce()", args)
+	if err != nil {
+		return nil, err
+	}
+	return &coalesceExpr{args, result}, nil
+}
+
+func (c *coalesceExpr) kind() valueKind {
+	return c.result
+}
+
+func (c *coalesceExpr) eval(row []interface{}) (interface{}, error) {
+	for _, arg := range c.args {
+		value, err := arg.eval(row)
+		if err != nil || value != nil {
+			return value, err
+		}
+	}
+	return nil, nil
+}
+
+// commonKind is the kind shared by args, ignoring NULLs.
+func commonKind(name string, args []expr) (valueKind, error) {
+	result := kindNull
+	for _, arg := range args {
+		switch k := arg.kind(); {
+		case k == kindNull || k == result:
+		case result == kindNull:
+			result = k
+		case k == kindAny || result == kindAny:
+			result = kindAny
+		default:
+			return 0, fmt.Errorf("arguments of %s mix %s and %s", name, result, k)
+		}
+	}
+	return result, nil
+}
+
+// Implementations
+
+func stringFunc(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return f(args[0].(string)), nil
+	}
+}
+
+func floatFunc(f func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if n, ok := args[0].(int64); ok {
+			return n, nil // already whole
+		}
+		return f(args[0].(float64)), nil
+	}
+}
+
+func timePart(f func(time.Time) int) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return int64(f(args[0].(time.Time))), nil
+	}
+}
+
+func intArg(value interface{}) int {
+	if n, ok := value.(int64); ok {
+		return int(n)
+	}
+	return int(value.(float64))
+}
+
+func fnLength(args []interface{}) (interface{}, error) {
+	return int64(utf8.RuneCountInString(args[0].(string))), nil
+}
+
+// fnSubstr is substr(s, start[, length]) counting characters from 1 as SQL does.
+func fnSubstr(args []interface{}) (interface{}, error) {
+	runes := []rune(args[0].(string))
+	start := intArg(args[1]) - 1
+	if start < 0 {
+		start = 0
+	}
+	if start > len(runes) {
+		return "", nil
+	}
+	end := len(runes)
+	if len(args) > 2 && args[2] != nil {
+		// compared as a difference so a huge length can't overflow
+		if length := intArg(args[2]); length >= 0 && length < end-start {
+			end = start + length
+		}
+	}
+	return string(runes[start:end]), nil
+}
+
+func fnLeft(args []interface{}) (interface{}, error) {
+	runes := []rune(args[0].(string))
+	n := intArg(args[1])
+	if n < 0 {
+		n = 0
+	}
+	if n < len(runes) {
+		runes = runes[:n]
+	}
+	return string(runes), nil
+}
+
+func fnRight(args []interface{}) (interface{}, error) {
+	runes := []rune(args[0].(string))
+	n := intArg(args[1])
+	if n < 0 {
+		n = 0
+	}
+	if n < len(runes) {
+		runes = runes[len(runes)-n:]
+	}
+	return string(runes), nil
+}
+
+func fnReplace(args []interface{}) (interface{}, error) {
+	return strings.ReplaceAll(args[0].(string), args[1].(string), args[2].(string)), nil
+}
+
+// fnConcat joins its arguments, skipping NULLs rather than returning NULL
+// like the || operator does.
+func fnConcat(args []interface{}) (interface{}, error) {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(toString(arg))
+	}
+	return b.String(), nil
+}
+
+func fnAbs(args []interface{}) (interface{}, error) {
+	if n, ok := args[0].(int64); ok {
+		if n < 0 {
+			return -n, nil
+		}
+		return n, nil
+	}
+	return math.Abs(args[0].(float64)), nil
+}
+
+func fnRound(args []interface{}) (interface{}, error) {
+	places := 0
+	if len(args) > 1 && args[1] != nil {
+		places = intArg(args[1])
+	}
+	if n, ok := args[0].(int64); ok && places >= 0 {
+		return n, nil
+	}
+	f, err := toFloat(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if places < 0 {
+		// multiply back by a whole power of ten so round(47, -1) is exactly 50
+		scale := math.Pow(10, float64(-places))
+		return math.Round(f/scale) * scale, nil
+	}
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale, nil
+}
+
+// fnDateFormat formats using a Go reference time layout like 2006-01-02.
+func fnDateFormat(args []interface{}) (interface{}, error) {
+	return args[0].(time.Time).Format(args[1].(string)), nil
+}
+
+func fnDateAdd(args []interface{}) (interface{}, error) {
+	days, _ := toFloat(args[1])
+	return args[0].(time.Time).Add(time.Duration(days * float64(24*time.Hour))), nil
+}
+
+// fnDateDiff is the number of days from the second time to the first.
+func fnDateDiff(args []interface{}) (interface{}, error) {
+	days := args[0].(time.Time).Sub(args[1].(time.Time)).Hours() / 24
+	if days == math.Trunc(days) {
+		return int64(days), nil
+	}
+	return days, nil
+}
+
+// fnToDate parses a string with a Go layout, or the usual ISO forms when
+// no layout is given.
+func fnToDate(args []interface{}) (interface{}, error) {
+	if len(args) < 2 || args[1] == nil {
+		return parseTime(args[0].(string))
+	}
+	return time.Parse(args[1].(string), args[0].(string))
+}
+
+func fnNow(args []interface{}) (interface{}, error) {
+	return time.Now(), nil
+}
+
+func fnString(args []interface{}) (interface{}, error) {
+	return toString(args[0]), nil
+}
+
+func fnNumber(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case int64, float64:
+		return v, nil
+	case bool:
+		return int64(boolRank(v)), nil
+	}
+	return normalizeText(toString(args[0]), kindNumber)
+}
@@ -0,0 +1,388 @@
+package sqltocsv
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// defaultSortMemory is how many bytes of rows are held in memory before
+// a sorted run is spilled to a temporary file.
+const defaultSortMemory = 64 << 20
+
+// maxMergeRuns is how many runs are merged at once, to bound the number of
+// files open. With more, they're merged a batch at a time into longer runs
+// first.
+const maxMergeRuns = 64
+
+// externalSorter sorts rows too many to hold in memory at once. Rows are
+// gathered until they use about memory bytes, then sorted and spilled to
+// a temporary file as a run, and the runs are merged when reading back.
+// Rows that compare equal keep the order they were added in.
+type externalSorter struct {
+	less   func(a, b []string) bool
+	memory int
+	dir    string
+
+	rows    [][]string
+	size    int
+	runs    []string
+	nextRun uint64
+	aead    cipher.AEAD // seals the runs when set
+}
+
+func newExternalSorter(less func(a, b []string) bool, memory int, dir string) *externalSorter {
+	if memory <= 0 {
+		memory = defaultSortMemory
+	}
+	return &externalSorter{less: less, memory: memory, dir: dir}
+}
+
+// add copies row into the sorter.
+func (s *externalSorter) add(row []string) error {
+	s.rows = append(s.rows, append([]string(nil), row...))
+	s.size += 24 * (len(row) + 1)
+	for _, cell := range row {
+		s.size += len(cell)
+	}
+	if s.size >= s.memory {
+		return s.spill()
+	}
+	return nil
+}
+
+// encryptRuns has runs encrypted with AES-256-GCM under a key that is
+// only ever held in memory, so rows don't reach the disk in plaintext.
+func (s *externalSorter) encryptRuns() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.aead = aead
+	return nil
+}
+
+// spill sorts the rows in memory and writes them to a new run.
+func (s *externalSorter) spill() error {
+	sort.SliceStable(s.rows, func(i, j int) bool { return s.less(s.rows[i], s.rows[j]) })
+	run, err := s.createRun()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run.f.Name())
+	for _, row := range s.rows {
+		if err = run.write(row); err != nil {
+			break
+		}
+	}
+	if closeErr := run.close(); err == nil {
+		err = closeErr
+	}
+	s.rows, s.size = nil, 0
+	return err
+}
+
+// sorted returns the rows in order. Closing it removes the runs.
+func (s *externalSorter) sorted() (*sortedRows, error) {
+	if len(s.runs) == 0 {
+		sort.SliceStable(s.rows, func(i, j int) bool { return s.less(s.rows[i], s.rows[j]) })
+		rows := s.rows
+		s.rows = nil
+		return &sortedRows{memory: rows}, nil
+	}
+
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			s.remove()
+			return nil, err
+		}
+	}
+	// merge maxMergeRuns at a time until few enough are left to open at once
+	for len(s.runs) > maxMergeRuns {
+		var merged []string
+		for i := 0; i < len(s.runs); i += maxMergeRuns {
+			end := i + maxMergeRuns
+			if end > len(s.runs) {
+				end = len(s.runs)
+			}
+			fileName, err := s.mergeRuns(s.runs[i:end])
+			if err != nil {
+				s.runs = append(merged, s.runs[end:]...)
+				s.remove()
+				return nil, err
+			}
+			merged = append(merged, fileName)
+		}
+		s.runs = merged
+	}
+	runFiles := s.runs
+	s.runs = nil
+	return s.openRuns(runFiles)
+}
+
+// mergeRuns merges runFiles into a new run, removing them.
+func (s *externalSorter) mergeRuns(runFiles []string) (string, error) {
+	rows, err := s.openRuns(runFiles)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	run, err := s.createRun()
+	if err != nil {
+		return "", err
+	}
+	for {
+		var row []string
+		if row, err = rows.next(); err != nil {
+			break
+		}
+		if err = run.write(row); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if closeErr := run.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(run.f.Name())
+		return "", err
+	}
+	return run.f.Name(), nil
+}
+
+// openRuns merges runFiles, which are removed when the result is closed.
+// Rows that compare equal come from earlier runs first.
+func (s *externalSorter) openRuns(runFiles []string) (*sortedRows, error) {
+	merged := &sortedRows{merge: &runHeap{less: s.less}, runFiles: runFiles}
+	for i, fileName := range runFiles {
+		f, err := os.Open(fileName)
+		if err != nil {
+			merged.Close()
+			return nil, err
+		}
+		run := &sortRun{f: f, r: bufio.NewReader(f), aead: s.aead, order: i}
+		merged.open = append(merged.open, run)
+		if run.id, err = binary.ReadUvarint(run.r); err == nil {
+			err = run.advance()
+		}
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			merged.Close()
+			return nil, err
+		}
+		merged.merge.runs = append(merged.merge.runs, run)
+	}
+	heap.Init(merged.merge)
+	return merged, nil
+}
+
+// remove deletes any runs, for when sorting is abandoned.
+func (s *externalSorter) remove() {
+	for _, fileName := range s.runs {
+		os.Remove(fileName)
+	}
+	s.runs = nil
+}
+
+// sortedRows reads back the rows of an externalSorter in order.
+type sortedRows struct {
+	memory   [][]string
+	merge    *runHeap
+	open     []*sortRun
+	runFiles []string
+}
+
+// next returns the next row, or io.EOF after the last.
+func (r *sortedRows) next() ([]string, error) {
+	if r.merge == nil {
+		if len(r.memory) == 0 {
+			return nil, io.EOF
+		}
+		row := r.memory[0]
+		r.memory = r.memory[1:]
+		return row, nil
+	}
+
+	if r.merge.Len() == 0 {
+		return nil, io.EOF
+	}
+	run := r.merge.runs[0]
+	row := run.row
+	if err := run.advance(); err == io.EOF {
+		heap.Pop(r.merge)
+	} else if err != nil {
+		return nil, err
+	} else {
+		heap.Fix(r.merge, 0)
+	}
+	return row, nil
+}
+
+// Close removes the temporary runs.
+func (r *sortedRows) Close() error {
+	for _, run := range r.open {
+		run.f.Close()
+	}
+	for _, fileName := range r.runFiles {
+		os.Remove(fileName)
+	}
+	r.open, r.runFiles = nil, nil
+	return nil
+}
+
+// runWriter writes rows to a run. A run starts with its id, which with a
+// count of the rows makes each row's nonce when encrypted. Each row is its
+// length followed by the count of its cells and each cell's length and
+// bytes, so any cell reads back exactly.
+type runWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	aead   cipher.AEAD
+	id     uint64
+	count  uint64
+	record []byte
+}
+
+func (s *externalSorter) createRun() (*runWriter, error) {
+	f, err := os.CreateTemp(s.dir, "sqltocsv-sort-*")
+	if err != nil {
+		return nil, err
+	}
+	s.nextRun++
+	run := &runWriter{f: f, w: bufio.NewWriter(f), aead: s.aead, id: s.nextRun}
+	run.w.Write(binary.AppendUvarint(nil, run.id))
+	return run, nil
+}
+
+func (run *runWriter) write(row []string) error {
+	record := binary.AppendUvarint(run.record[:0], uint64(len(row)))
+	for _, cell := range row {
+		record = binary.AppendUvarint(record, uint64(len(cell)))
+		record = append(record, cell...)
+	}
+	if run.aead != nil {
+		record = run.aead.Seal(record[:0], runNonce(run.id, run.count), record, nil)
+	}
+	run.record = record
+	run.count++
+
+	var length [binary.MaxVarintLen64]byte
+	run.w.Write(length[:binary.PutUvarint(length[:], uint64(len(record)))])
+	_, err := run.w.Write(record)
+	return err
+}
+
+func (run *runWriter) close() error {
+	err := run.w.Flush()
+	if closeErr := run.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runNonce is the run's id and the row's number in it, so no two rows
+// sealed under a sorter's key share a nonce.
+func runNonce(id, count uint64) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(id))
+	return binary.BigEndian.AppendUint64(nonce, count)
+}
+
+// sortRun is a run being merged, holding its next row.
+type sortRun struct {
+	f      *os.File
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	id     uint64
+	count  uint64
+	record []byte
+	row    []string
+	order  int
+}
+
+// advance reads the run's next row, returning io.EOF after the last.
+func (run *sortRun) advance() error {
+	length, err := binary.ReadUvarint(run.r)
+	if err != nil {
+		return err
+	}
+	if uint64(cap(run.record)) < length {
+		run.record = make([]byte, length)
+	}
+	record := run.record[:length]
+	if _, err = io.ReadFull(run.r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if run.aead != nil {
+		if record, err = run.aead.Open(record[:0], runNonce(run.id, run.count), record, nil); err != nil {
+			return errors.New("sorted run failed authentication")
+		}
+	}
+	run.count++
+
+	cells, n := binary.Uvarint(record)
+	if n <= 0 {
+		return errCorruptRun
+	}
+	record = record[n:]
+	row := make([]string, 0, cells)
+	for i := uint64(0); i < cells; i++ {
+		cellLength, n := binary.Uvarint(record)
+		if n <= 0 || uint64(len(record)-n) < cellLength {
+			return errCorruptRun
+		}
+		row = append(row, string(record[n:n+int(cellLength)]))
+		record = record[n+int(cellLength):]
+	}
+	run.row = row
+	return nil
+}
+
+var errCorruptRun = errors.New("sorted run is corrupt")
+
+// runHeap orders runs by their next row, then by the order they were
+// spilled so equal rows come out as they went in.
+type runHeap struct {
+	runs []*sortRun
+	less func(a, b []string) bool
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.runs[i], h.runs[j]
+	if h.less(a.row, b.row) {
+		return true
+	}
+	if h.less(b.row, a.row) {
+		return false
+	}
+	return a.order < b.order
+}
+
+func (h *runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*sortRun)) }
+
+func (h *runHeap) Pop() interface{} {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
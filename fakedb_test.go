@@ -8,6 +8,7 @@
 package sqltocsv
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
@@ -54,6 +55,8 @@ type fakeDB struct {
 	free    []*fakeConn
 	tables  map[string]*table
 	badConn bool
+
+	lastTxOptions driver.TxOptions // from the last BeginTx
 }
 
 type table struct {
@@ -120,6 +123,8 @@ type fakeStmt struct {
 	placeholders int           // used by INSERT/SELECT: number of ? params
 
 	whereCol []string // used by SELECT (all placeholders)
+	whereOp  []string // used by SELECT: "=", ">=", ">" or "<" for each whereCol
+	limitArg int      // used by SELECT: index of the limit=? argument, or -1
 
 	placeholderConverter []driver.ValueConverter // used by INSERT
 }
@@ -243,6 +248,29 @@ func (c *fakeConn) Begin() (driver.Tx, error) {
 	return c.currTx, nil
 }
 
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if sql.IsolationLevel(opts.Isolation) > sql.LevelSerializable {
+		return nil, errors.New("fakedb: unsupported isolation level")
+	}
+	tx, err := c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	c.db.mu.Lock()
+	c.db.lastTxOptions = opts
+	c.db.mu.Unlock()
+	return tx, nil
+}
+
+// FakeTxOptions returns the options the last transaction on the fake
+// database name began with, for tests outside the package.
+func FakeTxOptions(name string) driver.TxOptions {
+	db := fdriver.(*fakeDriver).getDB(name)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.lastTxOptions
+}
+
 var hookPostCloseConn struct {
 	sync.Mutex
 	fn func(*fakeConn, error)
@@ -333,6 +361,7 @@ func errf(msg string, args ...interface{}) error {
 }
 
 // parts are table|selectCol1,selectCol2|whereCol=?,whereCol2=?
+// (whereCol>=? and whereCol<? also work on int64 columns)
 // (note that where columns must always contain ? marks,
 //  just a limitation for fakedb)
 func (c *fakeConn) prepareSelect(stmt *fakeStmt, parts []string) (driver.Stmt, error) {
@@ -342,11 +371,30 @@ func (c *fakeConn) prepareSelect(stmt *fakeStmt, parts []string) (driver.Stmt, e
 	}
 	stmt.table = parts[0]
 	stmt.colName = strings.Split(parts[1], ",")
+	stmt.limitArg = -1
 	for n, colspec := range strings.Split(parts[2], ",") {
 		if colspec == "" {
 			continue
 		}
-		nameVal := strings.Split(colspec, "=")
+		if colspec == "limit=?" {
+			// not a column: the most rows to return
+			stmt.limitArg = stmt.placeholders
+			stmt.placeholders++
+			continue
+		}
+		if stmt.limitArg >= 0 {
+			stmt.Close()
+			return nil, errf("SELECT on table %q has limit=? before %q; it must come last", stmt.table, colspec)
+		}
+		op := "="
+		if strings.Contains(colspec, ">=") {
+			op = ">="
+		} else if strings.Contains(colspec, ">") {
+			op = ">"
+		} else if strings.Contains(colspec, "<") {
+			op = "<"
+		}
+		nameVal := strings.Split(colspec, op)
 		if len(nameVal) != 2 {
 			stmt.Close()
 			return nil, errf("SELECT on table %q has invalid column spec of %q (index %d)", stmt.table, colspec, n)
@@ -363,6 +411,7 @@ func (c *fakeConn) prepareSelect(stmt *fakeStmt, parts []string) (driver.Stmt, e
 				stmt.table, column)
 		}
 		stmt.whereCol = append(stmt.whereCol, column)
+		stmt.whereOp = append(stmt.whereOp, op)
 		stmt.placeholders++
 	}
 	return stmt, nil
@@ -602,12 +651,14 @@ func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
 	defer t.mu.Unlock()
 
 	colIdx := make(map[string]int) // select column name -> column index in table
-	for _, name := range s.colName {
+	colType := make([]string, len(s.colName))
+	for i, name := range s.colName {
 		idx := t.columnIndex(name)
 		if idx == -1 {
 			return nil, fmt.Errorf("fakedb: unknown column name %q", name)
 		}
 		colIdx[name] = idx
+		colType[i] = t.coltype[idx]
 	}
 
 	mrows := []*row{}
@@ -616,6 +667,9 @@ rows:
 		// Process the where clause, skipping non-match rows. This is lazy
 		// and just uses fmt.Sprintf("%v") to test equality.  Good enough
 		// for test code.
+		if s.limitArg >= 0 && int64(len(mrows)) >= args[s.limitArg].(int64) {
+			break
+		}
 		for widx, wcol := range s.whereCol {
 			idx := t.columnIndex(wcol)
 			if idx == -1 {
@@ -626,6 +680,16 @@ rows:
 				// lazy hack to avoid sprintf %v on a []byte
 				tcol = string(bs)
 			}
+			if s.whereOp[widx] != "=" {
+				// ranges are only supported on integer columns
+				value, _ := tcol.(int64)
+				bound, _ := args[widx].(int64)
+				if (s.whereOp[widx] == ">=" && value < bound) || (s.whereOp[widx] == ">" && value <= bound) ||
+					(s.whereOp[widx] == "<" && value >= bound) {
+					continue rows
+				}
+				continue
+			}
 			if fmt.Sprintf("%v", tcol) != fmt.Sprintf("%v", args[widx]) {
 				continue rows
 			}
@@ -638,10 +702,11 @@ rows:
 	}
 
 	cursor := &rowsCursor{
-		pos:    -1,
-		rows:   mrows,
-		cols:   s.colName,
-		errPos: -1,
+		pos:     -1,
+		rows:    mrows,
+		cols:    s.colName,
+		colType: colType,
+		errPos:  -1,
 	}
 	return cursor, nil
 }
@@ -661,10 +726,11 @@ func (tx *fakeTx) Rollback() error {
 }
 
 type rowsCursor struct {
-	cols   []string
-	pos    int
-	rows   []*row
-	closed bool
+	cols    []string
+	colType []string
+	pos     int
+	rows    []*row
+	closed  bool
 
 	// errPos and err are for making Next return early with error.
 	errPos int
@@ -690,6 +756,42 @@ func (rc *rowsCursor) Columns() []string {
 	return rc.cols
 }
 
+// ColumnTypeDatabaseTypeName reports the fakedb column type upper cased,
+// without any length suffix or null prefix, e.g. "binary(16)" is "BINARY"
+// and "nullint64" is "INT64". Strings are reported as VARCHAR, as a real
+// database would.
+func (rc *rowsCursor) ColumnTypeDatabaseTypeName(index int) string {
+	name, _ := splitTypeLength(rc.colType[index])
+	name = strings.TrimPrefix(name, "null")
+	if name == "string" {
+		return "VARCHAR"
+	}
+	return strings.ToUpper(name)
+}
+
+// ColumnTypeLength reports the n from a column type of the form "type(n)".
+func (rc *rowsCursor) ColumnTypeLength(index int) (int64, bool) {
+	_, length := splitTypeLength(rc.colType[index])
+	return length, length > 0
+}
+
+// ColumnTypeNullable reports the fakedb null* types as nullable.
+func (rc *rowsCursor) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return strings.HasPrefix(rc.colType[index], "null"), true
+}
+
+func splitTypeLength(typ string) (string, int64) {
+	open := strings.Index(typ, "(")
+	if open == -1 || !strings.HasSuffix(typ, ")") {
+		return typ, 0
+	}
+	length, err := strconv.ParseInt(typ[open+1:len(typ)-1], 10, 64)
+	if err != nil {
+		return typ, 0
+	}
+	return typ[:open], length
+}
+
 func (rc *rowsCursor) Next(dest []driver.Value) error {
 	if rc.closed {
 		return errors.New("fakedb: cursor is closed")
@@ -749,6 +851,7 @@ func (fakeDriverString) ConvertValue(v interface{}) (driver.Value, error) {
 }
 
 func converterForType(typ string) driver.ValueConverter {
+	typ, _ = splitTypeLength(typ)
 	switch typ {
 	case "bool":
 		return driver.Bool
@@ -758,7 +861,7 @@ func converterForType(typ string) driver.ValueConverter {
 		return driver.Int32
 	case "string":
 		return driver.NotNull{Converter: fakeDriverString{}}
-	case "nullstring":
+	case "nullstring", "json", "jsonb", "_text":
 		return driver.Null{Converter: fakeDriverString{}}
 	case "int64":
 		// TODO(coopernurse): add type-specific converter
@@ -774,6 +877,8 @@ func converterForType(typ string) driver.ValueConverter {
 		return driver.Null{Converter: driver.DefaultParameterConverter}
 	case "datetime":
 		return driver.DefaultParameterConverter
+	case "blob", "binary", "uuid", "bytea":
+		return driver.Null{Converter: driver.DefaultParameterConverter}
 	}
 	panic("invalid fakedb column type of " + typ)
 }
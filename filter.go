@@ -0,0 +1,44 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// compileFilter compiles the Filter predicate against the query's columns.
+// It uses the same expression language as ComputedColumns, plus
+//
+//	x IN (a, b, ...)    x NOT IN (...)
+//	x LIKE 'a%_'        x ILIKE 'a%'      x NOT LIKE ...
+//	x REGEXP '^a+$'     x ~ '^a+$'
+//	x IS NULL           x IS NOT NULL
+//
+// Unknown columns and type errors are reported before any rows are read.
+func (c *Converter) compileFilter(rows *sql.Rows, columnNames []string) (expr, error) {
+	if c.Filter == "" {
+		return nil, nil
+	}
+	columns := exprColumns(rows, columnNames)
+	c.restrictExprColumns(columns)
+	filter, err := compileExpr(c.Filter, columns)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	if !kindBool.accepts(filter.kind()) {
+		return nil, fmt.Errorf("filter: must be true or false, got %s", filter.kind())
+	}
+	return filter, nil
+}
+
+// matches reports whether the scanned values pass filter. A NULL result,
+// like a WHERE clause, doesn't.
+func matches(filter expr, values []interface{}) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	result, err := filter.eval(values)
+	if err != nil {
+		return false, fmt.Errorf("filter: %w", err)
+	}
+	return result == true, nil
+}
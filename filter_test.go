@@ -0,0 +1,91 @@
+package sqltocsv_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		items  string
+	}{
+		{"qty > 5", "gadget"},
+		{"price = 2.5", "widget"},
+		{"item IN ('gadget', 'gizmo')", "gadget"},
+		{"item NOT IN ('gadget')", "widget"},
+		{"item LIKE 'w%t'", "widget"},
+		{"item LIKE '_adget'", "gadget"},
+		{"item ILIKE 'WID%'", "widget"},
+		{"item NOT LIKE 'w%'", "gadget"},
+		{"item ~ '^g.*t$'", "gadget"},
+		{"item REGEXP 'dg'", "widget,gadget"},
+		{"country IS NULL", "gadget"},
+		{"country IS NOT NULL", "widget"},
+		{"country = 'nz'", "widget"},
+		{"country != 'nz'", ""}, // NULL never matches, as in SQL
+		{"placed >= '2021-01-01'", "gadget"},
+		{"qty < 5 OR country IS NULL", "widget,gadget"},
+		{"qty < 5 AND country IS NULL", ""},
+		{"NOT (qty < 5)", "gadget"},
+		{"price * qty > 10", "gadget"},
+		{"upper(item) = 'WIDGET'", "widget"},
+	}
+
+	for _, test := range tests {
+		converter := sqltocsv.New(getOrderTestRows(t))
+		converter.Columns = []string{"item"}
+		converter.Filter = test.filter
+
+		csv, err := converter.WriteString()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.filter, err)
+			continue
+		}
+		items := strings.Join(strings.Split(strings.TrimSpace(csv), "\n")[1:], ",")
+		if items != test.items {
+			t.Errorf("%s: expected %q, got %q", test.filter, test.items, items)
+		}
+	}
+}
+
+func TestFilterErrorsBeforeScanning(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"shoe_size > 3", `unknown column "shoe_size"`},
+		{"qty + 1", "must be true or false"},
+		{"item > 3", "can't compare string > number"},
+		{"qty LIKE 'a%'", "pattern matching needs strings"},
+		{"item ~ '('", "error parsing regexp"},
+		{"country IS 'nz'", "expected NULL"},
+	}
+
+	for _, test := range tests {
+		converter := sqltocsv.New(getOrderTestRows(t))
+		converter.Filter = test.filter
+
+		csv, err := converter.WriteString()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: expected error containing %q, got %v", test.filter, test.want, err)
+		}
+		if csv != "" {
+			t.Errorf("%s: expected nothing written, got %q", test.filter, csv)
+		}
+	}
+}
+
+func TestFilterWithFlattenSample(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.Filter = "id = 2"
+	converter.FlattenJSON = []string{"attrs"}
+
+	expected := "id,attrs.color,attrs.stock,tags\n2,blue,5,{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
@@ -0,0 +1,135 @@
+package sqltocsv
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// HeaderTypes says whether the header carries each column's database type,
+// for loaders that need types to read the file back.
+type HeaderTypes int
+
+const (
+	// HeaderTypesNone writes plain column names (the default)
+	HeaderTypesNone HeaderTypes = iota
+	// HeaderTypesInline writes each header as name:type, like age:INT
+	HeaderTypesInline
+	// HeaderTypesRow writes a second header row of database type names
+	HeaderTypesRow
+)
+
+// headerRows returns the header row, and a row of types if HeaderTypes
+// asks for one. Columns the database type isn't known for, like computed
+// or masked ones, get an empty type.
+func (c Converter) headerRows(headers []string, fields []schemaField) [][]string {
+	types := make([]string, len(headers))
+	for i := range types {
+		if i < len(fields) {
+			types[i] = fields[i].dbType
+		}
+	}
+
+	switch c.HeaderTypes {
+	case HeaderTypesInline:
+		typed := make([]string, len(headers))
+		for i, header := range headers {
+			typed[i] = header
+			if types[i] != "" {
+				typed[i] += ":" + types[i]
+			}
+		}
+		return [][]string{typed}
+	case HeaderTypesRow:
+		return [][]string{append([]string(nil), headers...), types}
+	}
+	return [][]string{append([]string(nil), headers...)}
+}
+
+func (c Converter) commentChar() rune {
+	if c.CommentChar == 0 {
+		return '#'
+	}
+	return c.CommentChar
+}
+
+// commentLines are the lines writeComments writes, without the comment
+// character.
+func (c Converter) commentLines() []string {
+	lines := []string{"generated " + time.Now().UTC().Format(time.RFC3339)}
+	if c.Query != "" {
+		for i, line := range strings.Split(strings.TrimSpace(c.Query), "\n") {
+			if i == 0 {
+				line = "query: " + line
+			}
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+	}
+	return lines
+}
+
+// headerRowCount is how many rows headerRows writes.
+func (c Converter) headerRowCount() int {
+	switch {
+	case !c.WriteHeaders:
+		return 0
+	case c.HeaderTypes == HeaderTypesRow:
+		return 2
+	}
+	return 1
+}
+
+// writeComments writes the leading comment lines: when the file was
+// generated and, if set, the Query.
+func (c Converter) writeComments(w io.Writer) error {
+	prefix := string(c.commentChar()) + " "
+	for _, line := range c.commentLines() {
+		if _, err := io.WriteString(w, prefix+line+c.lineEnding()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecord writes row with csvWriter. When there are comment lines a
+// row starting with the comment character would be skipped by readers
+// looking for comments, so its first cell is quoted by hand.
+func (c Converter) writeRecord(csvWriter *csv.Writer, w io.Writer, row []string) error {
+	if !c.WriteComments || len(row) == 0 || !strings.HasPrefix(row[0], string(c.commentChar())) {
+		return csvWriter.Write(row)
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+	first := `"` + strings.ReplaceAll(row[0], `"`, `""`) + `"`
+	if len(row) == 1 {
+		_, err := io.WriteString(w, first+c.lineEnding())
+		return err
+	}
+	if _, err := io.WriteString(w, first+string(csvWriter.Comma)); err != nil {
+		return err
+	}
+	return csvWriter.Write(row[1:])
+}
+
+// lineEnding is what the csv.Writer ends each row with.
+func (c Converter) lineEnding() string {
+	if c.UseCRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// checkCommentChar makes sure the comment character can't be confused
+// with the rest of the CSV syntax.
+func (c Converter) checkCommentChar() error {
+	comment := c.commentChar()
+	if comment == '"' || comment == '\r' || comment == '\n' || comment == c.Delimiter || (c.Delimiter == 0 && comment == ',') {
+		return fmt.Errorf("CommentChar %q can't be used with this Delimiter", comment)
+	}
+	return nil
+}
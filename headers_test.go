@@ -0,0 +1,113 @@
+package sqltocsv_test
+
+import (
+	"encoding/csv"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestHeaderTypesInline(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+	converter.HeaderTypes = sqltocsv.HeaderTypesInline
+	converter.ComputedColumns = []sqltocsv.ComputedColumn{{Name: "total", Expression: "price * qty"}}
+	converter.Columns = []string{"item", "qty", "country", "total"}
+
+	expected := "item:VARCHAR,qty:INT32,country:VARCHAR,total\n" +
+		"widget,3,nz,7.5\n" +
+		"gadget,10,,40\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestHeaderTypesRow(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+	converter.HeaderTypes = sqltocsv.HeaderTypesRow
+	converter.Columns = []string{"item", "price"}
+
+	expected := "item,price\n" +
+		"VARCHAR,FLOAT64\n" +
+		"widget,2.5\n" +
+		"gadget,4\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestWriteComments(t *testing.T) {
+	converter := getConverter(t)
+	converter.WriteComments = true
+	converter.CommentChar = ';'
+	converter.Query = "SELECT name, age, bdate\nFROM people"
+
+	actual := converter.String()
+
+	lines := strings.Split(actual, "\n")
+	if !regexp.MustCompile(`^; generated \d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ$`).MatchString(lines[0]) {
+		t.Errorf("unexpected first comment line %q", lines[0])
+	}
+	expected := "; query: SELECT name, age, bdate\n" +
+		"; FROM people\n" +
+		"name,age,bdate\n" +
+		"Alice,1,1973-11-29 21:33:09 +0000 UTC\n"
+	assertCsvMatch(t, expected, strings.Join(lines[1:], "\n"))
+}
+
+func TestWriteCommentsWithCRLF(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|tags|tag=string")
+	exec(t, db, "INSERT|tags|tag=?", "#1")
+	exec(t, db, "INSERT|tags|tag=?", "two")
+	rows, err := db.Query("SELECT|tags|tag|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+
+	converter := sqltocsv.New(rows)
+	converter.WriteComments = true
+	converter.UseCRLF = true
+	converter.Query = "SELECT tag FROM tags"
+
+	actual := converter.String()
+	if strings.Count(actual, "\n") != strings.Count(actual, "\r\n") {
+		t.Errorf("expected every line to end with CRLF, got %q", actual)
+	}
+	if !strings.HasSuffix(actual, "# query: SELECT tag FROM tags\r\ntag\r\n\"#1\"\r\ntwo\r\n") {
+		t.Errorf("unexpected CSV %q", actual)
+	}
+}
+
+func TestWriteCommentsQuotesRowsStartingWithCommentChar(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|tags|tag=string,label=string")
+	exec(t, db, "INSERT|tags|tag=?,label=?", "#1", "first")
+	rows, err := db.Query("SELECT|tags|tag,label|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+
+	converter := sqltocsv.New(rows)
+	converter.WriteComments = true
+
+	reader := csv.NewReader(strings.NewReader(converter.String()))
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := [][]string{{"tag", "label"}, {"#1", "first"}}
+	if !reflect.DeepEqual(expected, records) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+
+	converter = getConverter(t)
+	converter.WriteComments = true
+	converter.CommentChar = ','
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for a comment character that is the delimiter")
+	}
+}
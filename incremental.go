@@ -0,0 +1,379 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IncrementalExport exports only the rows added or changed since its last
+// run, going by a high-water mark column like updated_at.
+//
+// Query is a template with {{since}} where the watermark goes, like
+//
+//	SELECT * FROM orders WHERE updated_at >= {{since}}
+//
+// Compare with >= rather than >, as rows committed after a run can share
+// the largest watermark value it saw. Rows at that value are remembered
+// by KeyColumn, and those already exported are skipped next run.
+type IncrementalExport struct {
+	DB              *sql.DB
+	Name            string // names the watermark in the Store, and dated files
+	Query           string
+	WatermarkColumn string
+	KeyColumn       string // unique column identifying rows at the watermark
+
+	Start       interface{}        // {{since}} for the first run, when there's no watermark saved yet (required)
+	Store       WatermarkStore     // where watermarks are kept (default is WatermarkFile(Name + ".watermark.json"))
+	Placeholder func(n int) string // query placeholder for the nth argument, counting from 1 (default is ?)
+	Configure   func(c *Converter) // sets up the Converter for each run
+}
+
+// Watermark is how far an IncrementalExport has got.
+type Watermark struct {
+	Value interface{}   // largest WatermarkColumn value exported
+	Keys  []interface{} // KeyColumn of the rows exported with that value
+}
+
+// WatermarkStore keeps an IncrementalExport's watermark between runs.
+type WatermarkStore interface {
+	// LoadWatermark returns nil if no watermark has been saved for name
+	LoadWatermark(name string) (*Watermark, error)
+	SaveWatermark(name string, watermark Watermark) error
+}
+
+// WatermarkFile is a WatermarkStore keeping watermarks by name in a JSON
+// file. It is safe to share between exports in the same process.
+type WatermarkFile string
+
+var watermarkFileMu sync.Mutex
+
+type savedWatermark struct {
+	Type     string   `json:"type"`
+	Value    string   `json:"value"`
+	KeyType  string   `json:"key_type,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	Modified string   `json:"modified"`
+}
+
+func (f WatermarkFile) read() (map[string]savedWatermark, error) {
+	saved := map[string]savedWatermark{}
+	encoded, err := os.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return saved, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(encoded, &saved); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f, err)
+	}
+	return saved, nil
+}
+
+// LoadWatermark reads the watermark saved for name.
+func (f WatermarkFile) LoadWatermark(name string) (*Watermark, error) {
+	watermarkFileMu.Lock()
+	defer watermarkFileMu.Unlock()
+	saved, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := saved[name]
+	if !ok {
+		return nil, nil
+	}
+
+	var watermark Watermark
+	if watermark.Value, err = decodeKey(entry.Type, entry.Value); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f, err)
+	}
+	for _, encoded := range entry.Keys {
+		key, err := decodeKey(entry.KeyType, encoded)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f, err)
+		}
+		watermark.Keys = append(watermark.Keys, key)
+	}
+	return &watermark, nil
+}
+
+// SaveWatermark saves the watermark for name, keeping those of other
+// names in the file.
+func (f WatermarkFile) SaveWatermark(name string, watermark Watermark) error {
+	watermarkFileMu.Lock()
+	defer watermarkFileMu.Unlock()
+	saved, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	entry := savedWatermark{Modified: time.Now().UTC().Format(time.RFC3339)}
+	if entry.Type, entry.Value, err = encodeKey(watermark.Value); err != nil {
+		return err
+	}
+	for _, key := range watermark.Keys {
+		keyType, encoded, err := encodeKey(key)
+		if err != nil {
+			return err
+		}
+		entry.KeyType = keyType
+		entry.Keys = append(entry.Keys, encoded)
+	}
+	saved[name] = entry
+
+	encoded, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(string(f), append(encoded, '\n'))
+}
+
+// AppendFile appends the rows since the last run to csvFileName, with
+// headers only if the file is new or empty, and returns how many rows it
+// wrote. If the export fails the file is cut back to how it was and the
+// watermark is left alone. Encryption isn't supported.
+func (e IncrementalExport) AppendFile(csvFileName string) (int64, error) {
+	f, err := os.OpenFile(csvFileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	n, next, err := e.run(f, true, size > 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(size)
+		return 0, err
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+	return n, e.commit(next)
+}
+
+// WriteDatedFile writes the rows since the last run to a new file in dir
+// named for Name and the time of the run, like
+// orders-20261019T070000Z.csv, returning the file name and how many rows
+// it wrote. The file is written even when there are no new rows.
+func (e IncrementalExport) WriteDatedFile(dir string) (string, int64, error) {
+	fileName := filepath.Join(dir, e.Name+"-"+time.Now().UTC().Format("20060102T150405Z")+".csv")
+	staged, err := createStaged(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(staged.Name()) // fails harmlessly once renamed
+
+	n, next, err := e.run(staged, false, false)
+	if err != nil {
+		staged.Close()
+		return "", 0, err
+	}
+	if err = staged.Close(); err != nil {
+		return "", 0, err
+	}
+	if err = os.Rename(staged.Name(), fileName); err != nil {
+		return "", 0, err
+	}
+	return fileName, n, e.commit(next)
+}
+
+func (e IncrementalExport) store() WatermarkStore {
+	if e.Store == nil {
+		return WatermarkFile(e.Name + ".watermark.json")
+	}
+	return e.Store
+}
+
+// run writes the rows since the last watermark to w, returning how many
+// it wrote and the watermark for commit to save once they're safely
+// stored. With appendFile it's for AppendFile, and continuing leaves out
+// the headers for a file that already has some.
+func (e IncrementalExport) run(w io.Writer, appendFile, continuing bool) (int64, *Watermark, error) {
+	if e.Name == "" || e.WatermarkColumn == "" || e.KeyColumn == "" {
+		return 0, nil, errors.New("IncrementalExport needs a Name, WatermarkColumn and KeyColumn")
+	}
+	last, err := e.store().LoadWatermark(e.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if last == nil {
+		if e.Start == nil {
+			return 0, nil, errors.New("IncrementalExport needs a Start for its first run")
+		}
+		last = &Watermark{Value: e.Start}
+	}
+
+	query, args := bindQuery(e.Query, e.Placeholder, map[string]interface{}{"since": last.Value})
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	tracker, err := newWatermarkTracker(rows, e.WatermarkColumn, e.KeyColumn, last)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	converter := New(rows)
+	if e.Configure != nil {
+		e.Configure(converter)
+	}
+	if appendFile && converter.Encryption != nil {
+		// each run would add its own encrypted stream, and the file wouldn't decrypt
+		return 0, nil, errors.New("appended files can't be encrypted, use WriteDatedFile")
+	}
+	converter.onScan = tracker.scanned
+	if continuing {
+		converter.WriteHeaders = false
+		converter.WriteComments = false
+		if converter.ExcelSafe {
+			w = &skipWriter{w: w, skip: len(byteOrderMark(converter.Encoding))}
+		}
+	}
+	if err = converter.Write(w); err != nil {
+		return 0, nil, err
+	}
+	return tracker.rows, tracker.next(), nil
+}
+
+// commit saves the watermark from run, if it moved.
+func (e IncrementalExport) commit(next *Watermark) error {
+	if next == nil {
+		return nil
+	}
+	return e.store().SaveWatermark(e.Name, *next)
+}
+
+// watermarkTracker skips the rows already exported at the last watermark
+// and works out the next one.
+type watermarkTracker struct {
+	watermarkIndex, keyIndex int
+	kind                     valueKind // of the watermark column
+	last                     *Watermark
+	exported                 map[string]bool // encoded keys of the rows at last.Value
+	max                      interface{}
+	maxKeys                  []interface{}
+	rows                     int64
+}
+
+func newWatermarkTracker(rows *sql.Rows, watermarkColumn, keyColumn string, last *Watermark) (*watermarkTracker, error) {
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	t := &watermarkTracker{watermarkIndex: -1, keyIndex: -1, last: last, exported: map[string]bool{}}
+	for i, name := range columnNames {
+		if name == watermarkColumn {
+			t.watermarkIndex = i
+		}
+		if name == keyColumn {
+			t.keyIndex = i
+		}
+	}
+	if t.watermarkIndex == -1 || t.keyIndex == -1 {
+		return nil, fmt.Errorf("the query needs columns %s and %s", watermarkColumn, keyColumn)
+	}
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		t.kind = exprKindOf(columnTypes[t.watermarkIndex])
+	}
+	// so a Start like 0 compares with the int64 values scanned
+	value, err := normalizeValue(last.Value, t.kind)
+	if err != nil {
+		return nil, fmt.Errorf("watermark %v: %w", last.Value, err)
+	}
+	t.last = &Watermark{Value: value, Keys: last.Keys}
+	for _, key := range last.Keys {
+		t.exported[keyString(key)] = true
+	}
+	return t, nil
+}
+
+func keyString(key interface{}) string {
+	if b, ok := key.([]byte); ok {
+		key = string(b)
+	}
+	return fmt.Sprintf("%T:%v", key, key)
+}
+
+func (t *watermarkTracker) scanned(values []interface{}) (bool, error) {
+	value, err := normalizeValue(values[t.watermarkIndex], t.kind)
+	if err != nil {
+		return false, err
+	}
+	key := values[t.keyIndex]
+	if value == nil {
+		t.rows++
+		return true, nil // can't be compared, so doesn't move the watermark
+	}
+
+	cmp, err := compareValues(value, t.last.Value)
+	if err != nil {
+		return false, err
+	}
+	if cmp == 0 && t.exported[keyString(key)] {
+		return false, nil
+	}
+
+	if t.max != nil {
+		cmp, err = compareValues(value, t.max)
+		if err != nil {
+			return false, err
+		}
+	}
+	if t.max == nil || cmp > 0 {
+		t.max, t.maxKeys = value, nil
+		cmp = 0
+	}
+	if cmp == 0 {
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+		t.maxKeys = append(t.maxKeys, key)
+	}
+	t.rows++
+	return true, nil
+}
+
+// next returns the watermark to save, or nil if it hasn't moved.
+func (t *watermarkTracker) next() *Watermark {
+	if t.max == nil {
+		return nil
+	}
+	if cmp, _ := compareValues(t.max, t.last.Value); cmp == 0 {
+		// still at the same value, so remember every row exported at it
+		return &Watermark{Value: t.max, Keys: append(append([]interface{}(nil), t.last.Keys...), t.maxKeys...)}
+	}
+	return &Watermark{Value: t.max, Keys: t.maxKeys}
+}
+
+// writeFileAtomically writes data to fileName through a temporary file,
+// so a crash leaves either the old contents or the new.
+func writeFileAtomically(fileName string, data []byte) error {
+	f, err := createStaged(fileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
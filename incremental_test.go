@@ -0,0 +1,202 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func setupOrdersDatabase(t *testing.T) *sql.DB {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|orders|id=int64,updated=int64,item=string")
+	insertOrder(t, db, 1, 10, "apple")
+	insertOrder(t, db, 2, 20, "banana")
+	insertOrder(t, db, 3, 20, "cherry")
+	return db
+}
+
+func insertOrder(t *testing.T, db *sql.DB, id, updated int64, item string) {
+	exec(t, db, "INSERT|orders|id=?,updated=?,item=?", id, updated, item)
+}
+
+func newOrdersExport(db *sql.DB, dir string) sqltocsv.IncrementalExport {
+	return sqltocsv.IncrementalExport{
+		DB:              db,
+		Name:            "orders",
+		Query:           "SELECT|orders|id,updated,item|updated>={{since}}",
+		WatermarkColumn: "updated",
+		KeyColumn:       "id",
+		Start:           int64(0),
+		Store:           sqltocsv.WatermarkFile(filepath.Join(dir, "state.json")),
+	}
+}
+
+func TestIncrementalExportAppendFile(t *testing.T) {
+	db := setupOrdersDatabase(t)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "orders.csv")
+	export := newOrdersExport(db, dir)
+
+	if n, err := export.AppendFile(fileName); err != nil || n != 3 {
+		t.Fatalf("expected 3 rows, got %d and %v", n, err)
+	}
+	watermark, err := export.Store.LoadWatermark("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &sqltocsv.Watermark{Value: int64(20), Keys: []interface{}{int64(2), int64(3)}}
+	if !reflect.DeepEqual(watermark, expected) {
+		t.Errorf("expected watermark %+v, got %+v", expected, watermark)
+	}
+
+	// a late row at the watermark is picked up, the ones exported aren't repeated
+	insertOrder(t, db, 4, 20, "date")
+	insertOrder(t, db, 5, 30, "elderberry")
+	if n, err := export.AppendFile(fileName); err != nil || n != 2 {
+		t.Fatalf("expected 2 rows, got %d and %v", n, err)
+	}
+
+	if n, err := export.AppendFile(fileName); err != nil || n != 0 {
+		t.Fatalf("expected no rows, got %d and %v", n, err)
+	}
+
+	insertOrder(t, db, 6, 30, "fig")
+	if n, err := export.AppendFile(fileName); err != nil || n != 1 {
+		t.Fatalf("expected 1 row, got %d and %v", n, err)
+	}
+	watermark, _ = export.Store.LoadWatermark("orders")
+	expected = &sqltocsv.Watermark{Value: int64(30), Keys: []interface{}{int64(5), int64(6)}}
+	if !reflect.DeepEqual(watermark, expected) {
+		t.Errorf("expected watermark %+v, got %+v", expected, watermark)
+	}
+
+	actual, _ := os.ReadFile(fileName)
+	assertCsvMatch(t, "id,updated,item\n1,10,apple\n2,20,banana\n3,20,cherry\n4,20,date\n5,30,elderberry\n6,30,fig\n", string(actual))
+}
+
+func TestIncrementalExportFailureLeavesFileAndWatermark(t *testing.T) {
+	db := setupOrdersDatabase(t)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "orders.csv")
+	export := newOrdersExport(db, dir)
+	if _, err := export.AppendFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(fileName)
+
+	insertOrder(t, db, 4, 40, "date")
+	export.Configure = func(c *sqltocsv.Converter) { c.StrictWidth, c.Headers = true, []string{"only one"} }
+	if _, err := export.AppendFile(fileName); err == nil {
+		t.Fatal("expected the export to fail")
+	}
+	after, _ := os.ReadFile(fileName)
+	assertCsvMatch(t, string(before), string(after))
+	watermark, _ := export.Store.LoadWatermark("orders")
+	if watermark.Value != int64(20) {
+		t.Errorf("expected the watermark to stay at 20, got %v", watermark.Value)
+	}
+}
+
+// memoryStore is a WatermarkStore for tests.
+type memoryStore map[string]sqltocsv.Watermark
+
+func (s memoryStore) LoadWatermark(name string) (*sqltocsv.Watermark, error) {
+	if watermark, ok := s[name]; ok {
+		return &watermark, nil
+	}
+	return nil, nil
+}
+
+func (s memoryStore) SaveWatermark(name string, watermark sqltocsv.Watermark) error {
+	s[name] = watermark
+	return nil
+}
+
+func TestIncrementalExportWriteDatedFile(t *testing.T) {
+	db := setupOrdersDatabase(t)
+	dir := t.TempDir()
+	store := memoryStore{"orders": {Value: int64(10), Keys: []interface{}{int64(1)}}}
+	export := newOrdersExport(db, dir)
+	export.Store = store
+
+	fileName, n, err := export.WriteDatedFile(dir)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 rows, got %d and %v", n, err)
+	}
+	if base := filepath.Base(fileName); !strings.HasPrefix(base, "orders-") || !strings.HasSuffix(base, "Z.csv") {
+		t.Errorf("unexpected file name %s", fileName)
+	}
+	actual, _ := os.ReadFile(fileName)
+	assertCsvMatch(t, "id,updated,item\n2,20,banana\n3,20,cherry\n", string(actual))
+	if store["orders"].Value != int64(20) {
+		t.Errorf("expected the watermark to move to 20, got %v", store["orders"].Value)
+	}
+}
+
+func TestIncrementalExportNeedsStart(t *testing.T) {
+	db := setupOrdersDatabase(t)
+	dir := t.TempDir()
+	export := newOrdersExport(db, dir)
+	export.Start = nil
+	if _, err := export.AppendFile(filepath.Join(dir, "orders.csv")); err == nil {
+		t.Error("expected an error without a Start or saved watermark")
+	}
+}
+
+func TestIncrementalExportIntegerWatermarks(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|orders|id=int64,updated=int64,item=string")
+	// the same as float64, but not as int64
+	insertOrder(t, db, 1, 1<<53, "apple")
+	insertOrder(t, db, 2, 1<<53+1, "banana")
+	dir := t.TempDir()
+	export := newOrdersExport(db, dir)
+	export.Start = 0
+
+	if n, err := export.AppendFile(filepath.Join(dir, "orders.csv")); err != nil || n != 2 {
+		t.Fatalf("expected 2 rows, got %d and %v", n, err)
+	}
+	watermark, err := export.Store.LoadWatermark("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &sqltocsv.Watermark{Value: int64(1<<53 + 1), Keys: []interface{}{int64(2)}}
+	if !reflect.DeepEqual(watermark, expected) {
+		t.Errorf("expected watermark %+v, got %+v", expected, watermark)
+	}
+}
+
+func TestIncrementalExportEncryption(t *testing.T) {
+	db := setupOrdersDatabase(t)
+	dir := t.TempDir()
+	export := newOrdersExport(db, dir)
+	encryption := sqltocsv.Encryption{Passphrase: "correct horse"}
+	export.Configure = func(c *sqltocsv.Converter) {
+		c.Encryption = &encryption
+		c.ExcelSafe = true
+	}
+
+	// a second encrypted stream on the end would spoil the first
+	fileName := filepath.Join(dir, "orders.csv")
+	if _, err := export.AppendFile(fileName); err == nil {
+		t.Fatal("expected an error appending encrypted rows")
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty file to be left, got %v %v", info, err)
+	}
+	if watermark, _ := export.Store.LoadWatermark("orders"); watermark != nil {
+		t.Errorf("expected no watermark saved, got %+v", watermark)
+	}
+
+	datedFile, n, err := export.WriteDatedFile(dir)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 rows, got %d and %v", n, err)
+	}
+	encrypted, _ := os.ReadFile(datedFile)
+	assertCsvMatch(t, "\ufeffid,updated,item\n1,10,apple\n2,20,banana\n3,20,cherry\n", decrypt(t, encrypted, encryption))
+}
@@ -0,0 +1,436 @@
+package sqltocsv
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JSONFormat says how JSON columns are written to the CSV.
+type JSONFormat int
+
+const (
+	// JSONAsIs writes JSON exactly as the database sent it (the default)
+	JSONAsIs JSONFormat = iota
+	// JSONCompact strips all insignificant whitespace
+	JSONCompact
+	// JSONPretty indents with two spaces, one member per line
+	JSONPretty
+)
+
+// ArrayMode says how array columns are written to the CSV.
+type ArrayMode int
+
+const (
+	// ArrayAsIs writes arrays exactly as the database sent them (the default)
+	ArrayAsIs ArrayMode = iota
+	// ArrayJoin writes the elements joined with ArraySeparator
+	ArrayJoin
+	// ArrayExplode writes one CSV row per element, repeating the other
+	// columns. Several array columns in one row are exploded side by side
+	// (like unnest) with the shorter ones padded with empty cells.
+	ArrayExplode
+)
+
+// defaultFlattenSample is how many rows are read to discover the keys of a
+// FlattenJSON column when FlattenKeys doesn't declare them.
+const defaultFlattenSample = 100
+
+// shaper reshapes formatted rows for JSON and array columns. It is built
+// once per Write from the Converter settings and the query's column types.
+type shaper struct {
+	c           *Converter
+	columnNames []string
+	json        []bool
+	array       []bool
+	flatten     [][]string // keys per column, nil if not flattened
+	flattened   []bool
+	single      [][]string // reused to return one row untouched
+}
+
+func (c *Converter) newShaper(rows *sql.Rows, columnNames []string) (*shaper, error) {
+	s := &shaper{
+		c:           c,
+		columnNames: columnNames,
+		json:        make([]bool, len(columnNames)),
+		array:       make([]bool, len(columnNames)),
+		flatten:     make([][]string, len(columnNames)),
+		flattened:   make([]bool, len(columnNames)),
+	}
+
+	var typeNames []string
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		for _, columnType := range columnTypes {
+			typeNames = append(typeNames, strings.ToUpper(columnType.DatabaseTypeName()))
+		}
+	}
+
+	for i, name := range columnNames {
+		typeName := ""
+		if i < len(typeNames) {
+			typeName = typeNames[i]
+		}
+		s.json[i] = typeName == "JSON" || typeName == "JSONB" || contains(c.JSONColumns, name)
+		s.array[i] = isArrayType(typeName) || contains(c.ArrayColumns, name)
+		if c.ArrayMode == ArrayExplode && c.restricted(name) {
+			s.array[i] = false
+		}
+	}
+
+	for _, name := range c.FlattenJSON {
+		i := indexOf(columnNames, name)
+		if i == -1 {
+			return nil, fmt.Errorf("FlattenJSON column %q is not in the query", name)
+		}
+		s.json[i] = true
+		s.flattened[i] = true
+		s.flatten[i] = c.FlattenKeys[name]
+	}
+
+	if s.passthrough() {
+		s.single = make([][]string, 1)
+	}
+	return s, nil
+}
+
+// needsSample reports whether some FlattenJSON column has to have its keys
+// discovered from the data.
+func (s *shaper) needsSample() bool {
+	for i, flattened := range s.flattened {
+		if flattened && s.flatten[i] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *shaper) sampleSize() int {
+	if s.c.FlattenSample > 0 {
+		return s.c.FlattenSample
+	}
+	return defaultFlattenSample
+}
+
+// discoverKeys sets the keys of undeclared FlattenJSON columns to every key
+// seen in sample, in the order they first appear. Keys that only turn up
+// after the sample are not written.
+func (s *shaper) discoverKeys(sample [][]string) error {
+	for i, flattened := range s.flattened {
+		if !flattened || s.flatten[i] != nil {
+			continue
+		}
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, row := range sample {
+			members, err := flattenJSON(row[i])
+			if err != nil {
+				return fmt.Errorf("column %q: %w", s.columnNames[i], err)
+			}
+			for _, member := range members {
+				if !seen[member.key] {
+					seen[member.key] = true
+					keys = append(keys, member.key)
+				}
+			}
+		}
+		s.flatten[i] = keys
+	}
+	return nil
+}
+
+// outputColumnNames returns the column names after flattening, where a
+// flattened column is replaced by one column.key column per key.
+func (s *shaper) outputColumnNames() []string {
+	names := []string{}
+	for i, name := range s.columnNames {
+		if !s.flattened[i] {
+			names = append(names, name)
+			continue
+		}
+		for _, key := range s.flatten[i] {
+			names = append(names, name+"."+key)
+		}
+	}
+	return names
+}
+
+// passthrough reports whether apply would return every row unchanged.
+func (s *shaper) passthrough() bool {
+	for i := range s.columnNames {
+		if s.flattened[i] || (s.array[i] && s.c.ArrayMode != ArrayAsIs) || (s.json[i] && s.c.JSONFormat != JSONAsIs) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply turns one formatted row into the rows to write. The returned
+// slice is only valid until the next call.
+func (s *shaper) apply(row []string) ([][]string, error) {
+	if s.single != nil {
+		s.single[0] = row
+		return s.single, nil
+	}
+	out := make([]string, 0, len(row))
+	exploded := map[int][]string{}
+	longest := 1
+
+	for i, value := range row {
+		switch {
+		case s.flattened[i]:
+			cells, err := s.flattenCells(i, value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, cells...)
+			continue
+		case s.array[i] && s.c.ArrayMode != ArrayAsIs:
+			elements, err := parseArray(value)
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %w", s.columnNames[i], err)
+			}
+			if s.c.ArrayMode == ArrayJoin {
+				value = strings.Join(elements, s.arraySeparator())
+				break
+			}
+			exploded[len(out)] = elements
+			if len(elements) > longest {
+				longest = len(elements)
+			}
+		case s.json[i]:
+			formatted, err := formatJSON(value, s.c.JSONFormat)
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %w", s.columnNames[i], err)
+			}
+			value = formatted
+		}
+		out = append(out, value)
+	}
+
+	if len(exploded) == 0 {
+		return [][]string{out}, nil
+	}
+
+	rows := make([][]string, longest)
+	for n := range rows {
+		rows[n] = append([]string(nil), out...)
+		for i, elements := range exploded {
+			rows[n][i] = ""
+			if n < len(elements) {
+				rows[n][i] = elements[n]
+			}
+		}
+	}
+	return rows, nil
+}
+
+func (s *shaper) flattenCells(i int, value string) ([]string, error) {
+	members, err := flattenJSON(value)
+	if err != nil {
+		return nil, fmt.Errorf("column %q: %w", s.columnNames[i], err)
+	}
+	cells := make([]string, len(s.flatten[i]))
+	for _, member := range members {
+		if n := indexOf(s.flatten[i], member.key); n != -1 {
+			cells[n] = member.value
+		}
+	}
+	return cells, nil
+}
+
+func (s *shaper) arraySeparator() string {
+	if s.c.ArraySeparator != "" {
+		return s.c.ArraySeparator
+	}
+	return ";"
+}
+
+func formatJSON(value string, format JSONFormat) (string, error) {
+	if value == "" || format == JSONAsIs {
+		return value, nil
+	}
+	buffer := bytes.Buffer{}
+	var err error
+	if format == JSONPretty {
+		err = json.Indent(&buffer, []byte(value), "", "  ")
+	} else {
+		err = json.Compact(&buffer, []byte(value))
+	}
+	if err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+type jsonMember struct {
+	key   string
+	value string
+}
+
+// flattenJSON walks a JSON object and returns its leaf members in document
+// order with nested object keys joined by dots. Arrays are leaves written
+// as compact JSON. An empty string or JSON null has no members.
+func flattenJSON(value string) ([]jsonMember, error) {
+	if value == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("can't flatten %q, it isn't a JSON object", value)
+	}
+
+	members := []jsonMember{}
+	if err := flattenObject(decoder, "", &members); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON object in %q", value)
+	}
+	return members, nil
+}
+
+// flattenObject reads members until the closing brace of an object whose
+// opening brace has already been consumed. Nested objects are decoded raw
+// and flattened in turn under their key.
+func flattenObject(decoder *json.Decoder, prefix string, members *[]jsonMember) error {
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := prefix + token.(string)
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		if raw[0] != '{' {
+			*members = append(*members, jsonMember{key: key, value: jsonLeaf(raw)})
+			continue
+		}
+
+		nested := json.NewDecoder(bytes.NewReader(raw))
+		nested.UseNumber()
+		if _, err := nested.Token(); err != nil {
+			return err
+		}
+		if err := flattenObject(nested, key+".", members); err != nil {
+			return err
+		}
+	}
+	_, err := decoder.Token() // closing brace
+	return err
+}
+
+// jsonLeaf renders a leaf JSON value as a CSV cell: strings unquoted, null
+// empty and everything else as compact JSON.
+func jsonLeaf(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, raw); err != nil {
+		return string(raw)
+	}
+	return compact.String()
+}
+
+// isArrayType reports whether a driver type name is an array: lib/pq and
+// pgx prefix the element type with an underscore, others use a [] suffix.
+func isArrayType(typeName string) bool {
+	return strings.HasPrefix(typeName, "_") || strings.HasSuffix(typeName, "[]") || typeName == "ARRAY"
+}
+
+// parseArray splits a Postgres array literal such as {a,"b c",NULL} or a
+// JSON array into its elements. Nested arrays are kept as single elements.
+func parseArray(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if value[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal([]byte(value), &raws); err != nil {
+			return nil, err
+		}
+		elements := make([]string, len(raws))
+		for i, raw := range raws {
+			elements[i] = jsonLeaf(raw)
+		}
+		return elements, nil
+	}
+	if value[0] != '{' || value[len(value)-1] != '}' {
+		return nil, fmt.Errorf("%q is not an array", value)
+	}
+
+	body := value[1 : len(value)-1]
+	elements := []string{}
+	if body == "" {
+		return elements, nil
+	}
+
+	var element strings.Builder
+	quoted, wasQuoted, depth := false, false, 0
+	for i := 0; i < len(body); i++ {
+		ch := body[i]
+		switch {
+		case ch == '\\' && i+1 < len(body):
+			i++
+			element.WriteByte(body[i])
+		case ch == '"' && depth == 0:
+			quoted = !quoted
+			wasQuoted = true
+		case ch == '{' && !quoted:
+			depth++
+			element.WriteByte(ch)
+		case ch == '}' && !quoted:
+			depth--
+			element.WriteByte(ch)
+		case ch == ',' && !quoted && depth == 0:
+			elements = append(elements, arrayElement(element.String(), wasQuoted))
+			element.Reset()
+			wasQuoted = false
+		default:
+			element.WriteByte(ch)
+		}
+	}
+	if quoted || depth != 0 {
+		return nil, fmt.Errorf("%q is not a well formed array", value)
+	}
+	return append(elements, arrayElement(element.String(), wasQuoted)), nil
+}
+
+func arrayElement(element string, quoted bool) string {
+	if !quoted && element == "NULL" {
+		return ""
+	}
+	return element
+}
+
+func contains(list []string, value string) bool {
+	return indexOf(list, value) != -1
+}
+
+func indexOf(list []string, value string) int {
+	for i, item := range list {
+		if item == value {
+			return i
+		}
+	}
+	return -1
+}
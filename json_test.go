@@ -0,0 +1,165 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestJSONAsIsByDefault(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	expected := "id,attrs,tags\n" +
+		"1,\"{ \"\"color\"\": \"\"red\"\", \"\"size\"\": {\"\"w\"\": 2, \"\"h\"\": 3} }\",\"{a,\"\"b,c\"\",NULL}\"\n" +
+		"2,\"{\"\"color\"\": \"\"blue\"\", \"\"stock\"\": 5}\",{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestJSONCompact(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.JSONFormat = sqltocsv.JSONCompact
+
+	expected := "id,attrs,tags\n" +
+		"1,\"{\"\"color\"\":\"\"red\"\",\"\"size\"\":{\"\"w\"\":2,\"\"h\"\":3}}\",\"{a,\"\"b,c\"\",NULL}\"\n" +
+		"2,\"{\"\"color\"\":\"\"blue\"\",\"\"stock\"\":5}\",{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestJSONPretty(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|docs|doc=nullstring")
+	exec(t, db, "INSERT|docs|doc=?", `{"a":[1,2]}`)
+	rows, err := db.Query("SELECT|docs|doc|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+
+	converter := sqltocsv.New(rows)
+	converter.JSONColumns = []string{"doc"}
+	converter.JSONFormat = sqltocsv.JSONPretty
+
+	expected := "doc\n\"{\n  \"\"a\"\": [\n    1,\n    2\n  ]\n}\"\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestFlattenJSONDiscoversKeys(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.FlattenJSON = []string{"attrs"}
+
+	expected := "id,attrs.color,attrs.size.w,attrs.size.h,attrs.stock,tags\n" +
+		"1,red,2,3,,\"{a,\"\"b,c\"\",NULL}\"\n" +
+		"2,blue,,,5,{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestFlattenJSONSampleLimitsKeys(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.FlattenJSON = []string{"attrs"}
+	converter.FlattenSample = 1
+
+	expected := "id,attrs.color,attrs.size.w,attrs.size.h,tags\n" +
+		"1,red,2,3,\"{a,\"\"b,c\"\",NULL}\"\n" +
+		"2,blue,,,{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestFlattenJSONDeclaredKeys(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.FlattenJSON = []string{"attrs"}
+	converter.FlattenKeys = map[string][]string{"attrs": {"stock", "color"}}
+
+	expected := "id,attrs.stock,attrs.color,tags\n" +
+		"1,,red,\"{a,\"\"b,c\"\",NULL}\"\n" +
+		"2,5,blue,{}\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestFlattenJSONUnknownColumn(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.FlattenJSON = []string{"missing"}
+
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error flattening a column not in the query")
+	}
+}
+
+func TestArrayJoin(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.ArrayMode = sqltocsv.ArrayJoin
+	converter.ArraySeparator = "|"
+
+	expected := "id,attrs,tags\n" +
+		"1,\"{ \"\"color\"\": \"\"red\"\", \"\"size\"\": {\"\"w\"\": 2, \"\"h\"\": 3} }\",\"a|b,c|\"\n" +
+		"2,\"{\"\"color\"\": \"\"blue\"\", \"\"stock\"\": 5}\",\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestArrayExplode(t *testing.T) {
+	converter := sqltocsv.New(getJSONTestRows(t))
+
+	converter.ArrayMode = sqltocsv.ArrayExplode
+	converter.FlattenJSON = []string{"attrs"}
+	converter.FlattenKeys = map[string][]string{"attrs": {"color"}}
+
+	expected := "id,attrs.color,tags\n" +
+		"1,red,a\n" +
+		"1,red,\"b,c\"\n" +
+		"1,red,\n" +
+		"2,blue,\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestArrayExplodeJSONArray(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|orders|id=int32,items=json")
+	exec(t, db, "INSERT|orders|id=?,items=?", 7, `["apple", 2, null]`)
+	rows, err := db.Query("SELECT|orders|id,items|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+
+	converter := sqltocsv.New(rows)
+	converter.ArrayColumns = []string{"items"}
+	converter.ArrayMode = sqltocsv.ArrayExplode
+
+	expected := "id,items\n7,apple\n7,2\n7,\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func getJSONTestRows(t *testing.T) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|products|id=int32,attrs=jsonb,tags=_text")
+	exec(t, db, "INSERT|products|id=?,attrs=?,tags=?", 1, `{ "color": "red", "size": {"w": 2, "h": 3} }`, `{a,"b,c",NULL}`)
+	exec(t, db, "INSERT|products|id=?,attrs=?,tags=?", 2, `{"color": "blue", "stock": 5}`, `{}`)
+
+	rows, err := db.Query("SELECT|products|id,attrs,tags|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
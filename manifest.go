@@ -0,0 +1,151 @@
+package sqltocsv
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Manifest describes a file written by WriteFile. It is saved as JSON next
+// to the CSV, in csvFileName + ".manifest.json".
+type Manifest struct {
+	File        string    `json:"file"`
+	SHA256      string    `json:"sha256"`
+	Bytes       int64     `json:"bytes"`
+	Rows        int64     `json:"rows"`
+	Columns     []string  `json:"columns"`
+	QuerySHA256 string    `json:"query_sha256,omitempty"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+}
+
+// writeStats collects what the manifest needs to know about a Write.
+type writeStats struct {
+	started time.Time
+	rows    int64
+	bytes   int64
+	sum     hash.Hash
+	columns []string
+	fields  []schemaField
+}
+
+// countingWriter counts the bytes written through it into n.
+type countingWriter struct {
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeFileSidecars writes the checksum, manifest, signature and schema
+// files for csvFileName from the stats collected while writing it.
+func (c Converter) writeFileSidecars(csvFileName string, stats *writeStats) error {
+	digest := hex.EncodeToString(stats.sum.Sum(nil))
+	base := filepath.Base(csvFileName)
+
+	if err := c.writeSchema(csvFileName, stats.fields); err != nil {
+		return err
+	}
+
+	if c.WriteChecksum {
+		// the same format as sha256sum, so sha256sum -c can check it
+		line := digest + "  " + base + "\n"
+		if err := os.WriteFile(csvFileName+".sha256", []byte(line), 0644); err != nil {
+			return err
+		}
+	}
+
+	if !c.WriteManifest {
+		return nil
+	}
+	manifest := Manifest{
+		File:     base,
+		SHA256:   digest,
+		Bytes:    stats.bytes,
+		Rows:     stats.rows,
+		Columns:  stats.columns,
+		Started:  stats.started.UTC(),
+		Finished: time.Now().UTC(),
+	}
+	if c.Query != "" {
+		manifest.QuerySHA256 = QueryFingerprint(c.Query)
+	}
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if err = os.WriteFile(csvFileName+".manifest.json", encoded, 0644); err != nil {
+		return err
+	}
+
+	if c.SigningKey != nil {
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(c.SigningKey, encoded))
+		return os.WriteFile(csvFileName+".manifest.json.sig", []byte(signature+"\n"), 0644)
+	}
+	return nil
+}
+
+// QueryFingerprint is the hex SHA-256 of query with runs of whitespace
+// collapsed, so reformatting a query doesn't change its fingerprint.
+func QueryFingerprint(query string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(query), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyFile checks csvFileName against the manifest WriteFile wrote next
+// to it, returning the manifest if the file is unchanged. If publicKey is
+// given the manifest must also carry a valid signature from it.
+func VerifyFile(csvFileName string, publicKey ed25519.PublicKey) (*Manifest, error) {
+	encoded, err := os.ReadFile(csvFileName + ".manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	if publicKey != nil {
+		encodedSignature, err := os.ReadFile(csvFileName + ".manifest.json.sig")
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encodedSignature)))
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest signature: %w", err)
+		}
+		if !ed25519.Verify(publicKey, encoded, signature) {
+			return nil, errors.New("manifest signature is not valid")
+		}
+	}
+
+	var manifest Manifest
+	if err = json.Unmarshal(encoded, &manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	f, err := os.Open(csvFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	size, err := io.Copy(sum, f)
+	if err != nil {
+		return nil, err
+	}
+	if size != manifest.Bytes || hex.EncodeToString(sum.Sum(nil)) != manifest.SHA256 {
+		return nil, fmt.Errorf("%s doesn't match its manifest", csvFileName)
+	}
+	return &manifest, nil
+}
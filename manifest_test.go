@@ -0,0 +1,89 @@
+package sqltocsv_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestWriteFileChecksum(t *testing.T) {
+	converter := getConverter(t)
+	converter.WriteChecksum = true
+
+	csvFileName := filepath.Join(t.TempDir(), "people.csv")
+	if err := converter.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	contents, _ := os.ReadFile(csvFileName)
+	sum := sha256.Sum256(contents)
+	expected := hex.EncodeToString(sum[:]) + "  people.csv\n"
+	checksum, err := os.ReadFile(csvFileName + ".sha256")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(checksum) != expected {
+		t.Errorf("expected checksum file %q, got %q", expected, checksum)
+	}
+	if _, err := os.Stat(csvFileName + ".manifest.json"); !os.IsNotExist(err) {
+		t.Error("expected no manifest unless asked for")
+	}
+}
+
+func TestWriteFileSignedManifest(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	converter := getConverter(t)
+	converter.WriteManifest = true
+	converter.SigningKey = privateKey
+	converter.Query = "SELECT name, age,\n\tbdate FROM people"
+
+	csvFileName := filepath.Join(t.TempDir(), "people.csv")
+	if err := converter.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	manifest, err := sqltocsv.VerifyFile(csvFileName, publicKey)
+	if err != nil {
+		t.Fatalf("unexpected error verifying %v", err)
+	}
+	if manifest.File != "people.csv" || manifest.Rows != 1 || manifest.Bytes != 53 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	if !reflect.DeepEqual(manifest.Columns, []string{"name", "age", "bdate"}) {
+		t.Errorf("unexpected manifest columns %v", manifest.Columns)
+	}
+	if manifest.QuerySHA256 != sqltocsv.QueryFingerprint("SELECT name, age, bdate FROM people") {
+		t.Errorf("expected the query fingerprint to ignore whitespace, got %v", manifest.QuerySHA256)
+	}
+	if manifest.Finished.Before(manifest.Started) {
+		t.Errorf("expected finished %v after started %v", manifest.Finished, manifest.Started)
+	}
+
+	// a different key
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := sqltocsv.VerifyFile(csvFileName, otherKey); err == nil {
+		t.Error("expected an error verifying with the wrong key")
+	}
+
+	// a modified manifest
+	manifestFileName := csvFileName + ".manifest.json"
+	original, _ := os.ReadFile(manifestFileName)
+	os.WriteFile(manifestFileName, append(original, ' '), 0644)
+	if _, err := sqltocsv.VerifyFile(csvFileName, publicKey); err == nil {
+		t.Error("expected an error verifying a modified manifest")
+	}
+	os.WriteFile(manifestFileName, original, 0644)
+
+	// a modified CSV
+	os.WriteFile(csvFileName, []byte("name,age,bdate\nMallory,1,1973-11-29 21:33:09 +0000 UTC\n"), 0644)
+	if _, err := sqltocsv.VerifyFile(csvFileName, publicKey); err == nil {
+		t.Error("expected an error verifying a modified CSV")
+	}
+}
@@ -0,0 +1,296 @@
+package sqltocsv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// MaskMethod is how a MaskRule hides a column's values.
+type MaskMethod int
+
+const (
+	// MaskRedact replaces the whole value with Replacement (default is REDACTED)
+	MaskRedact MaskMethod = iota
+	// MaskPartial replaces all but the last KeepLast letters and digits
+	// with *, leaving punctuation alone so 021-555-1234 is ***-***-1234
+	MaskPartial
+	// MaskScramble swaps each digit for a digit and each letter for a letter
+	// of the same case, keeping the format. With a Key the same input always
+	// scrambles the same way; without one a random key is used per Write.
+	MaskScramble
+	// MaskHash replaces the value with the hex SHA-256 of Salt plus the value
+	MaskHash
+	// MaskHMAC replaces the value with the hex HMAC-SHA256 of the value
+	// under Key. The same value always gets the same pseudonym, so files
+	// exported with the same Key can still be joined on it.
+	MaskHMAC
+)
+
+// MaskRule masks the columns named Column, or whose names match Pattern.
+// When several rules match a column the first one wins.
+type MaskRule struct {
+	Column  string
+	Pattern *regexp.Regexp
+	Method  MaskMethod
+
+	Replacement string // for MaskRedact
+	KeepLast    int    // for MaskPartial (default is 4)
+	Salt        []byte // for MaskHash
+	Key         []byte // for MaskHMAC (required) and MaskScramble
+}
+
+// PIIWarningFunc is told about an unmasked column that looks like it holds
+// personal data. looksLike is "email" or "card number". It is called at
+// most once per column per Write.
+type PIIWarningFunc func(columnName string, looksLike string)
+
+func (rule MaskRule) matches(columnName string) bool {
+	if rule.Column != "" {
+		return rule.Column == columnName
+	}
+	return rule.Pattern.MatchString(columnName)
+}
+
+// masker applies the MaskRules to each row. It is set up once per Write
+// for the column names being written.
+type masker struct {
+	rules    []*MaskRule // rule for each column, nil if unmasked
+	warn     PIIWarningFunc
+	warned   []bool
+	names    []string
+	needed   bool
+	scramble []byte     // random key for MaskScramble rules without one
+	mu       sync.Mutex // guards warned when rows are formatted concurrently
+}
+
+// newMasker sets up masking for columnNames. A non-nil entry in overrides
+// masks that column with the given rule regardless of MaskRules.
+func (c *Converter) newMasker(columnNames []string, overrides []*MaskRule) (*masker, error) {
+	m := &masker{
+		rules:  make([]*MaskRule, len(columnNames)),
+		warn:   c.PIIWarning,
+		warned: make([]bool, len(columnNames)),
+		names:  columnNames,
+	}
+
+	for i := range c.MaskRules {
+		rule := &c.MaskRules[i]
+		if rule.Column == "" && rule.Pattern == nil {
+			return nil, fmt.Errorf("mask rule %d needs a Column or a Pattern", i+1)
+		}
+	}
+
+	rules := c.MaskRules
+	for _, rule := range overrides {
+		if rule != nil {
+			rules = append(rules[:len(rules):len(rules)], *rule)
+		}
+	}
+	for i, rule := range rules {
+		if rule.Method == MaskHMAC && len(rule.Key) == 0 {
+			return nil, fmt.Errorf("mask rule %d uses MaskHMAC without a Key", i+1)
+		}
+		if rule.Method == MaskScramble && len(rule.Key) == 0 && m.scramble == nil {
+			m.scramble = make([]byte, 32)
+			if _, err := rand.Read(m.scramble); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for n, name := range columnNames {
+		if overrides != nil && overrides[n] != nil {
+			m.rules[n] = overrides[n]
+			m.needed = true
+			continue
+		}
+		for i := range c.MaskRules {
+			if c.MaskRules[i].matches(name) {
+				m.rules[n] = &c.MaskRules[i]
+				m.needed = true
+				break
+			}
+		}
+	}
+	m.needed = m.needed || m.warn != nil
+	return m, nil
+}
+
+// apply masks row in place, and checks the unmasked cells for anything
+// that looks like personal data if there's a PIIWarning to tell.
+func (m *masker) apply(row []string) []string {
+	if !m.needed {
+		return row
+	}
+	for i, value := range row {
+		if i >= len(m.rules) || value == "" {
+			continue
+		}
+		if rule := m.rules[i]; rule != nil {
+			row[i] = m.mask(rule, value)
+			continue
+		}
+		if m.warn != nil {
+			m.checkPII(i, value)
+		}
+	}
+	return row
+}
+
+// checkPII warns about column i if value looks like personal data and it
+// hasn't been warned about already.
+func (m *masker) checkPII(i int, value string) {
+	m.mu.Lock()
+	warned := m.warned[i]
+	m.mu.Unlock()
+	if warned {
+		return
+	}
+
+	looksLike := detectPII(value)
+	if looksLike == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.warned[i] {
+		m.warned[i] = true
+		m.warn(m.names[i], looksLike)
+	}
+}
+
+func (m *masker) mask(rule *MaskRule, value string) string {
+	switch rule.Method {
+	case MaskPartial:
+		keep := rule.KeepLast
+		if keep == 0 {
+			keep = 4
+		}
+		return maskPartial(value, keep)
+	case MaskScramble:
+		key := rule.Key
+		if len(key) == 0 {
+			key = m.scramble
+		}
+		return scramble(value, key)
+	case MaskHash:
+		sum := sha256.Sum256(append(append([]byte(nil), rule.Salt...), value...))
+		return hex.EncodeToString(sum[:])
+	case MaskHMAC:
+		mac := hmac.New(sha256.New, rule.Key)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	if rule.Replacement != "" {
+		return rule.Replacement
+	}
+	return "REDACTED"
+}
+
+func maskPartial(value string, keep int) string {
+	runes := []rune(value)
+	kept := 0
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+// scramble replaces letters and digits using a keystream from HMAC-SHA256
+// of the value, so the result depends on both key and value.
+func scramble(value string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	seed := mac.Sum(nil)
+
+	var stream []byte
+	counter := uint64(0)
+	next := func() byte {
+		if len(stream) == 0 {
+			block := hmac.New(sha256.New, seed)
+			binary.Write(block, binary.BigEndian, counter)
+			stream = block.Sum(nil)
+			counter++
+		}
+		b := stream[0]
+		stream = stream[1:]
+		return b
+	}
+
+	var b strings.Builder
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteByte('0' + next()%10)
+		case r >= 'a' && r <= 'z':
+			b.WriteByte('a' + next()%26)
+		case r >= 'A' && r <= 'Z':
+			b.WriteByte('A' + next()%26)
+		case unicode.IsLetter(r):
+			b.WriteByte('a' + next()%26)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[A-Za-z]{2,}$`)
+
+// detectPII returns what value looks like if it might be personal data.
+func detectPII(value string) string {
+	value = strings.TrimSpace(value)
+	if emailPattern.MatchString(value) {
+		return "email"
+	}
+	if looksLikeCardNumber(value) {
+		return "card number"
+	}
+	return ""
+}
+
+// looksLikeCardNumber checks for 13 to 19 digits, optionally grouped with
+// spaces or dashes, that pass the Luhn check.
+func looksLikeCardNumber(value string) bool {
+	digits := make([]int, 0, 19)
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, int(r-'0'))
+		case r == ' ' || r == '-':
+		default:
+			return false
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,99 @@
+package sqltocsv_test
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestMaskRedactAndPartial(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	converter.MaskRules = []sqltocsv.MaskRule{
+		{Column: "email", Method: sqltocsv.MaskRedact},
+		{Pattern: regexp.MustCompile(`phone$`), Method: sqltocsv.MaskPartial},
+		{Column: "national_id", Method: sqltocsv.MaskRedact, Replacement: "xxx"},
+	}
+
+	expected := "name,email,mobile_phone,national_id,card\n" +
+		"Alice,REDACTED,***-***-1234,xxx,4111 1111 1111 1111\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestMaskHashAndHMAC(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	converter.MaskRules = []sqltocsv.MaskRule{
+		{Column: "email", Method: sqltocsv.MaskHMAC, Key: []byte("secret")},
+		{Column: "national_id", Method: sqltocsv.MaskHash, Salt: []byte("salt")},
+	}
+	converter.Columns = []string{"email", "national_id"}
+
+	expected := "email,national_id\n" +
+		"a398d49ce1980b3642bc4dbd110121e3c953e1eadb497d50dea23e9611f83ee7," +
+		"521a36e437476930008741deb91ad245879fd0022dd092f75eba33d80a6ef585\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestMaskScramblePreservesFormat(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	converter.MaskRules = []sqltocsv.MaskRule{
+		{Column: "national_id", Method: sqltocsv.MaskScramble, Key: []byte("k")},
+	}
+	converter.Columns = []string{"national_id"}
+
+	csv := converter.String()
+	scrambled := strings.Split(strings.TrimSpace(csv), "\n")[1]
+	if !regexp.MustCompile(`^[A-Z]{2}[0-9]{6}[A-Z]$`).MatchString(scrambled) || scrambled == "AB123456C" {
+		t.Errorf("expected a scrambled value shaped like AB123456C, got %q", scrambled)
+	}
+}
+
+func TestMaskRuleErrors(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	converter.MaskRules = []sqltocsv.MaskRule{{Column: "email", Method: sqltocsv.MaskHMAC}}
+
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for MaskHMAC without a key")
+	}
+}
+
+func TestPIIWarning(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	warnings := []string{}
+	converter.MaskRules = []sqltocsv.MaskRule{{Column: "national_id", Method: sqltocsv.MaskRedact}}
+	converter.PIIWarning = func(columnName, looksLike string) {
+		warnings = append(warnings, columnName+" looks like "+looksLike)
+	}
+	if _, err := converter.WriteString(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "email looks like email,card looks like card number"
+	if actual := strings.Join(warnings, ","); actual != expected {
+		t.Errorf("expected warnings %q, got %q", expected, actual)
+	}
+}
+
+func getCustomerTestRows(t *testing.T) *sql.Rows {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|customers|name=string,email=string,mobile_phone=string,national_id=string,card=string")
+	exec(t, db, "INSERT|customers|name=?,email=?,mobile_phone=?,national_id=?,card=?",
+		"Alice", "alice@example.com", "021-555-1234", "AB123456C", "4111 1111 1111 1111")
+
+	rows, err := db.Query("SELECT|customers|name,email,mobile_phone,national_id,card|")
+	if err != nil {
+		t.Fatalf("error querying: %v", err)
+	}
+	return rows
+}
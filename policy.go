@@ -0,0 +1,108 @@
+package sqltocsv
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy says which columns each role is allowed to export. Converter.Write
+// enforces it for the Role set on the Converter, failing closed: a column
+// the role's RolePolicy doesn't mention stops the export with an error
+// before any rows are written.
+//
+// The policy applies to the columns being written, so computed and
+// flattened JSON columns need to be listed by the names they are written
+// under. Filter and ComputedColumns can only read the query columns the
+// role is allowed to see as is, and ArrayExplode leaves the other array
+// columns whole, as the number of rows would give away their length.
+type Policy struct {
+	Roles map[string]RolePolicy
+}
+
+// RolePolicy lists the columns a role can see as is, can't see at all, and
+// can only see masked. If a column is in more than one list Deny wins over
+// Mask, and Mask over Allow.
+type RolePolicy struct {
+	Allow []string
+	Deny  []string
+	Mask  map[string]MaskRule // Column and Pattern on the rule are ignored
+}
+
+// AuditRecord describes how a Policy was applied to one export.
+type AuditRecord struct {
+	Time    time.Time
+	Role    string
+	Written []string // every column written, including the masked ones
+	Dropped []string
+	Masked  []string
+}
+
+// AuditFunc receives the AuditRecord for each export made under a Policy.
+type AuditFunc func(record AuditRecord)
+
+// applyPolicy drops the columns the Role is denied from selection and
+// returns the mask rule for each remaining column, nil where the column
+// is allowed as is.
+func (c *Converter) applyPolicy(selection *columnSelection) (*columnSelection, []*MaskRule, error) {
+	if c.Policy == nil {
+		return selection, nil, nil
+	}
+	role, ok := c.Policy.Roles[c.Role]
+	if !ok {
+		return nil, nil, fmt.Errorf("policy has no role %q", c.Role)
+	}
+
+	record := AuditRecord{Time: time.Now(), Role: c.Role}
+	keep := make([]bool, len(selection.names))
+	for i, name := range selection.names {
+		_, masked := role.Mask[name]
+		switch {
+		case contains(role.Deny, name):
+			record.Dropped = append(record.Dropped, name)
+		case masked:
+			record.Masked = append(record.Masked, name)
+			keep[i] = true
+		case contains(role.Allow, name):
+			keep[i] = true
+		default:
+			return nil, nil, fmt.Errorf("policy for role %q doesn't mention column %q", c.Role, name)
+		}
+	}
+
+	allowed := selection.keep(keep)
+	rules := make([]*MaskRule, len(allowed.names))
+	for i, name := range allowed.names {
+		if rule, ok := role.Mask[name]; ok {
+			rules[i] = &rule
+		}
+	}
+	record.Written = allowed.names
+
+	if c.PolicyAudit != nil {
+		c.PolicyAudit(record)
+	}
+	return allowed, rules, nil
+}
+
+// restrictExprColumns marks the columns the Role can't see as is, so
+// Filter and ComputedColumns can't read them: which rows pass a filter on
+// a denied or masked column, or what a computed column makes of it, would
+// leave with the rows as surely as the column itself.
+func (c *Converter) restrictExprColumns(columns []exprColumn) {
+	for i, column := range columns {
+		columns[i].restricted = c.restricted(column.name)
+	}
+}
+
+// restricted reports whether the Role can't see the column as is.
+func (c *Converter) restricted(name string) bool {
+	if c.Policy == nil {
+		return false
+	}
+	role, ok := c.Policy.Roles[c.Role]
+	if !ok {
+		return false // applyPolicy fails the export before any rows are written
+	}
+	_, masked := role.Mask[name]
+	return contains(role.Deny, name) || masked || !contains(role.Allow, name)
+}
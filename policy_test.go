@@ -0,0 +1,146 @@
+package sqltocsv_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+var supportPolicy = &sqltocsv.Policy{
+	Roles: map[string]sqltocsv.RolePolicy{
+		"support": {
+			Allow: []string{"name", "email", "mobile_phone"},
+			Deny:  []string{"national_id", "card"},
+			Mask:  map[string]sqltocsv.MaskRule{"mobile_phone": {Method: sqltocsv.MaskPartial}},
+		},
+		"analyst": {
+			Allow: []string{"name"},
+		},
+	},
+}
+
+func TestPolicyDropsAndMasksColumns(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	var records []sqltocsv.AuditRecord
+	converter.Policy = supportPolicy
+	converter.Role = "support"
+	converter.PolicyAudit = func(record sqltocsv.AuditRecord) {
+		records = append(records, record)
+	}
+
+	expected := "name,email,mobile_phone\n" +
+		"Alice,alice@example.com,***-***-1234\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 audit record, got %d", len(records))
+	}
+	record := records[0]
+	if record.Role != "support" || record.Time.IsZero() {
+		t.Errorf("unexpected audit record %+v", record)
+	}
+	if !reflect.DeepEqual(record.Written, []string{"name", "email", "mobile_phone"}) {
+		t.Errorf("unexpected written columns %v", record.Written)
+	}
+	if !reflect.DeepEqual(record.Dropped, []string{"national_id", "card"}) {
+		t.Errorf("unexpected dropped columns %v", record.Dropped)
+	}
+	if !reflect.DeepEqual(record.Masked, []string{"mobile_phone"}) {
+		t.Errorf("unexpected masked columns %v", record.Masked)
+	}
+}
+
+func TestPolicyFailsClosedOnUnmentionedColumn(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	audited := false
+	converter.Policy = supportPolicy
+	converter.Role = "analyst"
+	converter.PolicyAudit = func(record sqltocsv.AuditRecord) { audited = true }
+
+	csv, err := converter.WriteString()
+	if err == nil {
+		t.Fatal("expected an error for a column the policy doesn't mention")
+	}
+	if csv != "" || audited {
+		t.Errorf("expected nothing written or audited, got %q", csv)
+	}
+
+	// selecting only what the role may see is fine
+	converter = sqltocsv.New(getCustomerTestRows(t))
+	converter.Policy = supportPolicy
+	converter.Role = "analyst"
+	converter.Columns = []string{"name"}
+
+	assertCsvMatch(t, "name\nAlice\n", converter.String())
+}
+
+func TestPolicyUnknownRole(t *testing.T) {
+	converter := sqltocsv.New(getCustomerTestRows(t))
+
+	converter.Policy = supportPolicy
+	converter.Role = "intern"
+
+	if _, err := converter.WriteString(); err == nil {
+		t.Error("expected an error for a role not in the policy")
+	}
+}
+
+func TestPolicyRestrictsExpressions(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		set      func(c *sqltocsv.Converter)
+		expected string
+	}{
+		{"filter on a denied column", func(c *sqltocsv.Converter) { c.Filter = "national_id = '123'" }, `reading column "national_id"`},
+		{"filter on a masked column", func(c *sqltocsv.Converter) { c.Filter = "mobile_phone LIKE '555%'" }, `reading column "mobile_phone"`},
+		{"computed from a denied column", func(c *sqltocsv.Converter) {
+			c.ComputedColumns = []sqltocsv.ComputedColumn{{Name: "last4", Expression: "right(card, 4)"}}
+		}, `reading column "card"`},
+	} {
+		converter := sqltocsv.New(getCustomerTestRows(t))
+		converter.Policy = supportPolicy
+		converter.Role = "support"
+		test.set(converter)
+
+		_, err := converter.WriteString()
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error %s, got %v", test.name, test.expected, err)
+		}
+	}
+
+	// allowed columns can still be read
+	converter := sqltocsv.New(getCustomerTestRows(t))
+	converter.Policy = supportPolicy
+	converter.Role = "support"
+	converter.Filter = "name = 'Alice'"
+	converter.Columns = []string{"name", "email"}
+	assertCsvMatch(t, "name,email\nAlice,alice@example.com\n", converter.String())
+}
+
+func TestPolicyKeepsRestrictedArraysWhole(t *testing.T) {
+	policy := &sqltocsv.Policy{
+		Roles: map[string]sqltocsv.RolePolicy{
+			"denied": {Allow: []string{"id", "attrs"}, Deny: []string{"tags"}},
+			"masked": {Allow: []string{"id", "attrs"}, Mask: map[string]sqltocsv.MaskRule{"tags": {}}},
+		},
+	}
+	for role, expected := range map[string]string{
+		"denied": "id\n1\n2\n",
+		"masked": "id,tags\n1,REDACTED\n2,REDACTED\n",
+	} {
+		converter := sqltocsv.New(getJSONTestRows(t))
+		converter.Policy = policy
+		converter.Role = role
+		converter.ArrayMode = sqltocsv.ArrayExplode
+		converter.Columns = []string{"id", "tags"}
+
+		// one row per row read, whatever the length of the tags
+		assertCsvMatch(t, expected, converter.String())
+	}
+}
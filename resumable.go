@@ -0,0 +1,267 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ResumableExport pages through a query in key order, saving a checkpoint
+// after each page so an export that dies part way can carry on from the
+// last page written rather than starting over.
+//
+// Query is a template with {{after}} where the last key of the page
+// before goes, and {{limit}} where the page size goes, like
+//
+//	SELECT * FROM events WHERE id > {{after}} ORDER BY id LIMIT {{limit}}
+//
+// KeyColumn must be unique and the query must order by it, or rows will
+// be skipped or repeated between pages.
+type ResumableExport struct {
+	DB        *sql.DB
+	Query     string
+	KeyColumn string
+
+	Start       interface{}        // {{after}} for the first page, below every key (default is the smallest int64)
+	PageSize    int                // rows per page (default is 10000)
+	Checkpoint  string             // checkpoint file (default is the CSV file name with .checkpoint added)
+	Placeholder func(n int) string // query placeholder for the nth argument, counting from 1 (default is ?)
+	Configure   func(c *Converter) // sets up the Converter for each page
+}
+
+// Checkpoint is what a ResumableExport saves after each page: the last
+// key written and how much of the file is complete.
+type Checkpoint struct {
+	QuerySHA256 string `json:"query_sha256"`
+	KeyType     string `json:"key_type"`
+	LastKey     string `json:"last_key"`
+	Offset      int64  `json:"offset"`
+	Rows        int64  `json:"rows"`
+}
+
+// WriteFile writes the query's rows to csvFileName a page at a time. If a
+// checkpoint from an earlier attempt is found the file is cut back to the
+// end of the last page it records and the export continues after its
+// last key. The checkpoint is removed once the export is complete.
+//
+// Encryption isn't supported, and WriteFile's sidecar files aren't
+// written.
+func (e ResumableExport) WriteFile(csvFileName string) error {
+	checkpointFile := e.Checkpoint
+	if checkpointFile == "" {
+		checkpointFile = csvFileName + ".checkpoint"
+	}
+	pageSize := e.PageSize
+	if pageSize <= 0 {
+		pageSize = 10000
+	}
+
+	checkpoint, err := e.readCheckpoint(checkpointFile)
+	if err != nil {
+		return err
+	}
+	var after interface{}
+	var f *os.File
+	if checkpoint != nil {
+		if after, err = decodeKey(checkpoint.KeyType, checkpoint.LastKey); err != nil {
+			return fmt.Errorf("reading checkpoint: %w", err)
+		}
+		if f, err = os.OpenFile(csvFileName, os.O_RDWR, 0); err != nil {
+			return err
+		}
+		if err = f.Truncate(checkpoint.Offset); err == nil {
+			_, err = f.Seek(checkpoint.Offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		checkpoint = &Checkpoint{QuerySHA256: QueryFingerprint(e.Query)}
+		after = e.Start
+		if after == nil {
+			after = int64(math.MinInt64)
+		}
+		if f, err = os.Create(csvFileName); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	for {
+		scanned, lastKey, err := e.writePage(f, after, pageSize, checkpoint.Offset == 0)
+		if err != nil {
+			return err
+		}
+		if err = f.Sync(); err != nil {
+			return err
+		}
+		if checkpoint.Offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		checkpoint.Rows += scanned
+		if scanned < int64(pageSize) {
+			break
+		}
+
+		after = lastKey
+		if checkpoint.KeyType, checkpoint.LastKey, err = encodeKey(lastKey); err != nil {
+			return fmt.Errorf("key column %s: %w", e.KeyColumn, err)
+		}
+		if err = writeCheckpoint(checkpointFile, checkpoint); err != nil {
+			return err
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Remove(checkpointFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writePage writes the page of rows after the key after to w, returning
+// how many rows it scanned and the last of their keys. Only the first page
+// has the headers, comments and byte order mark.
+func (e ResumableExport) writePage(w io.Writer, after interface{}, pageSize int, first bool) (int64, interface{}, error) {
+	query, args := bindQuery(e.Query, e.Placeholder, map[string]interface{}{"after": after, "limit": int64(pageSize)})
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return 0, nil, err
+	}
+	keyIndex := -1
+	for i, name := range columnNames {
+		if name == e.KeyColumn {
+			keyIndex = i
+		}
+	}
+	if keyIndex == -1 {
+		return 0, nil, fmt.Errorf("the query has no key column %s", e.KeyColumn)
+	}
+
+	converter := New(rows)
+	if e.Configure != nil {
+		e.Configure(converter)
+	}
+	if converter.Encryption != nil {
+		return 0, nil, errors.New("resumable exports can't be encrypted")
+	}
+	var scanned int64
+	var lastKey interface{}
+	converter.onScan = func(values []interface{}) (bool, error) {
+		scanned++
+		lastKey = values[keyIndex]
+		return true, nil
+	}
+	if !first {
+		converter.WriteHeaders = false
+		converter.WriteComments = false
+		if converter.ExcelSafe {
+			w = &skipWriter{w: w, skip: len(byteOrderMark(converter.Encoding))}
+		}
+	}
+	if err = converter.Write(w); err != nil {
+		return 0, nil, err
+	}
+	return scanned, lastKey, nil
+}
+
+// skipWriter drops the first skip bytes written through it.
+type skipWriter struct {
+	w    io.Writer
+	skip int
+}
+
+func (w *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip > 0 {
+		dropped := w.skip
+		if dropped > len(p) {
+			dropped = len(p)
+		}
+		w.skip -= dropped
+		p = p[dropped:]
+	}
+	if _, err := w.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// readCheckpoint returns the checkpoint saved in fileName, or nil if
+// there isn't one.
+func (e ResumableExport) readCheckpoint(fileName string) (*Checkpoint, error) {
+	encoded, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	if err = json.Unmarshal(encoded, &checkpoint); err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	if checkpoint.QuerySHA256 != QueryFingerprint(e.Query) {
+		return nil, fmt.Errorf("checkpoint %s is for a different query", fileName)
+	}
+	return &checkpoint, nil
+}
+
+// writeCheckpoint saves checkpoint to fileName, so that a crash leaves
+// either the old checkpoint or the new one.
+func writeCheckpoint(fileName string, checkpoint *Checkpoint) error {
+	encoded, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(fileName, append(encoded, '\n'))
+}
+
+// encodeKey writes key as a string, with its type so decodeKey can give
+// back the same value.
+func encodeKey(key interface{}) (string, string, error) {
+	switch key := key.(type) {
+	case int64:
+		return "int64", strconv.FormatInt(key, 10), nil
+	case float64:
+		return "float64", strconv.FormatFloat(key, 'g', -1, 64), nil
+	case string:
+		return "string", key, nil
+	case []byte:
+		return "bytes", base64.StdEncoding.EncodeToString(key), nil
+	case time.Time:
+		return "time", key.Format(time.RFC3339Nano), nil
+	}
+	return "", "", fmt.Errorf("can't checkpoint a key of type %T", key)
+}
+
+func decodeKey(keyType, encoded string) (interface{}, error) {
+	switch keyType {
+	case "int64":
+		return strconv.ParseInt(encoded, 10, 64)
+	case "float64":
+		return strconv.ParseFloat(encoded, 64)
+	case "string":
+		return encoded, nil
+	case "bytes":
+		return base64.StdEncoding.DecodeString(encoded)
+	case "time":
+		return time.Parse(time.RFC3339Nano, encoded)
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
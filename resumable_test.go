@@ -0,0 +1,130 @@
+package sqltocsv_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+const resumableQuery = "SELECT|events|count,name|count>{{after}},limit={{limit}}"
+
+func expectedEvents(t *testing.T) string {
+	rows, err := setupEventsDatabase(t, 25).Query("SELECT|events|count,name|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = sqltocsv.Write(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestResumableExportWriteFile(t *testing.T) {
+	expected := expectedEvents(t)
+	db := setupEventsDatabase(t, 25)
+	fileName := filepath.Join(t.TempDir(), "events.csv")
+
+	export := sqltocsv.ResumableExport{DB: db, Query: resumableQuery, KeyColumn: "count", PageSize: 10}
+	if err := export.WriteFile(fileName); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	actual, _ := os.ReadFile(fileName)
+	assertCsvMatch(t, expected, string(actual))
+	if _, err := os.Stat(fileName + ".checkpoint"); !os.IsNotExist(err) {
+		t.Error("expected the checkpoint to be removed once complete")
+	}
+}
+
+func TestResumableExportResumes(t *testing.T) {
+	expected := expectedEvents(t)
+	db := setupEventsDatabase(t, 25)
+	fileName := filepath.Join(t.TempDir(), "events.csv")
+
+	pages := 0
+	export := sqltocsv.ResumableExport{
+		DB:        db,
+		Query:     resumableQuery,
+		KeyColumn: "count",
+		PageSize:  10,
+		Configure: func(c *sqltocsv.Converter) {
+			if pages++; pages == 3 {
+				c.Filter = "(((" // fails the last page
+			}
+		},
+	}
+	if err := export.WriteFile(fileName); err == nil {
+		t.Fatal("expected the third page to fail")
+	}
+
+	encoded, err := os.ReadFile(fileName + ".checkpoint")
+	if err != nil {
+		t.Fatalf("expected a checkpoint: %v", err)
+	}
+	var checkpoint sqltocsv.Checkpoint
+	if err = json.Unmarshal(encoded, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.KeyType != "int64" || checkpoint.LastKey != "19" || checkpoint.Rows != 20 {
+		t.Errorf("unexpected checkpoint %s", encoded)
+	}
+
+	// a half written page from the crash is cut off
+	f, _ := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString("20,ev")
+	f.Close()
+
+	pages = 0
+	export.Configure = func(*sqltocsv.Converter) { pages++ }
+	if err = export.WriteFile(fileName); err != nil {
+		t.Fatalf("WriteFile failed to resume: %v", err)
+	}
+	if pages != 1 {
+		t.Errorf("expected to resume with the last page, ran %d pages", pages)
+	}
+	actual, _ := os.ReadFile(fileName)
+	assertCsvMatch(t, expected, string(actual))
+}
+
+func TestResumableExportExcelSafe(t *testing.T) {
+	db := setupEventsDatabase(t, 3)
+	fileName := filepath.Join(t.TempDir(), "events.csv")
+
+	export := sqltocsv.ResumableExport{
+		DB:        db,
+		Query:     resumableQuery,
+		KeyColumn: "count",
+		PageSize:  2,
+		Configure: func(c *sqltocsv.Converter) { c.ExcelSafe = true },
+	}
+	if err := export.WriteFile(fileName); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	actual, _ := os.ReadFile(fileName)
+	if bytes.Count(actual, []byte("\ufeff")) != 1 || bytes.Count(actual, []byte("count,name")) != 1 {
+		t.Errorf("expected one byte order mark and header, got %q", actual)
+	}
+}
+
+func TestResumableExportDifferentQuery(t *testing.T) {
+	db := setupEventsDatabase(t, 3)
+	fileName := filepath.Join(t.TempDir(), "events.csv")
+	os.WriteFile(fileName+".checkpoint", []byte(`{"query_sha256": "abc", "key_type": "int64", "last_key": "1"}`), 0644)
+
+	export := sqltocsv.ResumableExport{DB: db, Query: resumableQuery, KeyColumn: "count"}
+	if err := export.WriteFile(fileName); err == nil {
+		t.Error("expected a checkpoint for another query to be refused")
+	}
+}
+
+func TestResumableExportMissingKeyColumn(t *testing.T) {
+	db := setupEventsDatabase(t, 3)
+	export := sqltocsv.ResumableExport{DB: db, Query: resumableQuery, KeyColumn: "id"}
+	if err := export.WriteFile(filepath.Join(t.TempDir(), "events.csv")); err == nil {
+		t.Error("expected an error for a key column the query doesn't have")
+	}
+}
@@ -0,0 +1,395 @@
+package sqltocsv
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SchemaFormat picks the machine readable schema WriteFile writes next to
+// the CSV, so consumers don't have to guess at column types.
+type SchemaFormat int
+
+const (
+	// SchemaNone writes no schema (the default)
+	SchemaNone SchemaFormat = iota
+	// SchemaCSVW writes W3C CSV on the Web metadata to csvFileName + "-metadata.json"
+	SchemaCSVW
+	// SchemaFrictionless writes a Frictionless Data Package with a Table
+	// Schema to csvFileName + ".datapackage.json"
+	SchemaFrictionless
+)
+
+// schemaField is what's known about one written column.
+type schemaField struct {
+	name      string
+	dbType    string // database type name, empty when unknown
+	kind      string // integer, number, string, boolean, date, time, datetime, object, binary
+	format    string // Go time layout for date and time kinds, binary encoding for binary
+	nullable  *bool
+	length    *int64
+	precision *int64
+	scale     *int64
+}
+
+// schemaFields describes the written columns. Types come from the query's
+// ColumnTypes; computed, flattened and masked columns, and any added by
+// row processors, are described as plain strings.
+func (c Converter) schemaFields(rows *sql.Rows, columnNames, outputColumnNames, headers []string, masker *masker) []schemaField {
+	byName := map[string]*sql.ColumnType{}
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		for i, columnType := range columnTypes {
+			if i < len(columnNames) {
+				byName[columnNames[i]] = columnType
+			}
+		}
+	}
+
+	fields := make([]schemaField, len(headers))
+	for i, header := range headers {
+		fields[i] = schemaField{name: header, kind: "string"}
+		if i >= len(outputColumnNames) || (i < len(masker.rules) && masker.rules[i] != nil) {
+			continue
+		}
+		columnType, ok := byName[outputColumnNames[i]]
+		if !ok {
+			continue
+		}
+		c.describeColumn(&fields[i], columnType)
+	}
+	return fields
+}
+
+func (c Converter) describeColumn(field *schemaField, columnType *sql.ColumnType) {
+	field.dbType = columnType.DatabaseTypeName()
+	if nullable, ok := columnType.Nullable(); ok {
+		field.nullable = &nullable
+	}
+	if length, ok := columnType.Length(); ok {
+		field.length = &length
+	}
+	if precision, scale, ok := columnType.DecimalSize(); ok {
+		field.precision, field.scale = &precision, &scale
+	}
+
+	switch kindOf(columnType) {
+	case binaryColumn:
+		switch c.BinaryEncoding {
+		case BinaryBase64:
+			field.kind, field.format = "binary", "base64"
+		case BinaryHex:
+			field.kind, field.format = "binary", "hex"
+		}
+		return
+	case uuidColumn:
+		field.format = "uuid"
+		return
+	}
+
+	switch typeName := databaseTypeName(columnType); {
+	case integerTypes[typeName]:
+		field.kind = "integer"
+	case typeName == "JSON" || typeName == "JSONB":
+		field.kind = "object"
+	case typeName == "DATE":
+		field.kind = "date"
+	case typeName == "TIME" || typeName == "TIMETZ":
+		field.kind = "time"
+	case typeName == "BOOL" || typeName == "BOOLEAN":
+		field.kind = "boolean"
+	default:
+		switch exprKindOf(columnType) {
+		case kindNumber:
+			field.kind = "number"
+		case kindTime:
+			field.kind = "datetime"
+		case kindBool:
+			field.kind = "boolean"
+		}
+	}
+
+	if field.kind == "number" && c.FloatFormat != "" {
+		// FloatFormat might write anything, so don't promise a number
+		field.kind = "string"
+	}
+	if field.kind == "date" || field.kind == "time" || field.kind == "datetime" {
+		field.format = c.TimeFormat
+		if field.format == "" {
+			field.format = "2006-01-02 15:04:05.999999999 -0700 MST" // time.Time's String
+		}
+	}
+}
+
+// writeSchema writes the Schema sidecar for csvFileName.
+func (c Converter) writeSchema(csvFileName string, fields []schemaField) error {
+	var document interface{}
+	var schemaFileName string
+	switch c.Schema {
+	case SchemaCSVW:
+		document = c.csvwMetadata(filepath.Base(csvFileName), fields)
+		schemaFileName = csvFileName + "-metadata.json"
+	case SchemaFrictionless:
+		document = c.dataPackage(filepath.Base(csvFileName), fields)
+		schemaFileName = csvFileName + ".datapackage.json"
+	default:
+		return nil
+	}
+
+	encoded, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(schemaFileName, append(encoded, '\n'), 0644)
+}
+
+func (c Converter) delimiter() string {
+	if c.Delimiter == '\x00' {
+		return ","
+	}
+	return string(c.Delimiter)
+}
+
+func (c Converter) encodingName() string {
+	if c.Encoding == "" {
+		return string(UTF8)
+	}
+	return string(c.Encoding)
+}
+
+// csvwMetadata follows https://www.w3.org/TR/tabular-metadata/
+func (c Converter) csvwMetadata(url string, fields []schemaField) map[string]interface{} {
+	columns := make([]map[string]interface{}, len(fields))
+	for i, field := range fields {
+		datatype := map[string]interface{}{}
+		switch field.kind {
+		case "integer":
+			datatype["base"] = "integer"
+		case "number":
+			datatype["base"] = "decimal"
+		case "boolean":
+			datatype["base"] = "boolean"
+			datatype["format"] = "true|false"
+		case "object":
+			datatype["base"] = "json"
+		case "binary":
+			datatype["base"] = map[string]string{"base64": "base64Binary", "hex": "hexBinary"}[field.format]
+		case "date", "time", "datetime":
+			if pattern, ok := goLayoutToUnicode(field.format); ok {
+				datatype["base"] = field.kind
+				datatype["format"] = pattern
+			} else {
+				datatype["base"] = "string"
+			}
+		default:
+			datatype["base"] = "string"
+		}
+		if field.length != nil && field.kind == "string" {
+			datatype["maxLength"] = *field.length
+		}
+
+		column := map[string]interface{}{
+			"name":     csvwName(field.name, i),
+			"titles":   field.name,
+			"datatype": datatype,
+		}
+		if field.nullable != nil {
+			column["required"] = !*field.nullable
+		}
+		if field.dbType != "" {
+			column["dc:description"] = "database type " + field.dbType + describeSize(field)
+		}
+		columns[i] = column
+	}
+
+	dialect := map[string]interface{}{
+		"delimiter":      c.delimiter(),
+		"encoding":       c.encodingName(),
+		"header":         c.WriteHeaders,
+		"headerRowCount": c.headerRowCount(),
+	}
+	if c.WriteComments {
+		dialect["commentPrefix"] = string(c.commentChar())
+		dialect["skipRows"] = len(c.commentLines())
+	}
+	return map[string]interface{}{
+		"@context": "http://www.w3.org/ns/csvw",
+		"url":      url,
+		"dialect":  dialect,
+		"tableSchema": map[string]interface{}{
+			"columns": columns,
+			"null":    "",
+		},
+	}
+}
+
+// dataPackage follows https://specs.frictionlessdata.io/data-package/
+func (c Converter) dataPackage(path string, fields []schemaField) map[string]interface{} {
+	entries := make([]map[string]interface{}, len(fields))
+	for i, field := range fields {
+		entry := map[string]interface{}{"name": field.name}
+		switch field.kind {
+		case "binary":
+			entry["type"] = "string"
+			if field.format == "base64" {
+				entry["format"] = "binary"
+			}
+		case "date", "time", "datetime":
+			if pattern, ok := goLayoutToStrftime(field.format); ok {
+				entry["type"] = field.kind
+				entry["format"] = pattern
+			} else {
+				entry["type"] = "string"
+			}
+		default:
+			entry["type"] = field.kind
+		}
+		if field.format == "uuid" {
+			entry["format"] = "uuid"
+		}
+
+		constraints := map[string]interface{}{}
+		if field.nullable != nil && !*field.nullable {
+			constraints["required"] = true
+		}
+		if field.length != nil && entry["type"] == "string" {
+			constraints["maxLength"] = *field.length
+		}
+		if len(constraints) > 0 {
+			entry["constraints"] = constraints
+		}
+		if field.dbType != "" {
+			entry["description"] = "database type " + field.dbType + describeSize(field)
+		}
+		entries[i] = entry
+	}
+
+	dialect := map[string]interface{}{
+		"delimiter": c.delimiter(),
+		"header":    c.WriteHeaders,
+	}
+	if rows := c.headerRowCount(); rows > 0 {
+		headerRows := make([]int, rows)
+		for i := range headerRows {
+			headerRows[i] = i + 1
+		}
+		dialect["headerRows"] = headerRows
+	}
+	if c.WriteComments {
+		dialect["commentChar"] = string(c.commentChar())
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(path, filepath.Ext(path)))
+	return map[string]interface{}{
+		"name": frictionlessName(name),
+		"resources": []map[string]interface{}{{
+			"name":      frictionlessName(name),
+			"path":      path,
+			"profile":   "tabular-data-resource",
+			"format":    "csv",
+			"mediatype": "text/csv",
+			"encoding":  c.encodingName(),
+			"dialect":   dialect,
+			"schema": map[string]interface{}{
+				"fields":        entries,
+				"missingValues": []string{""},
+			},
+		}},
+	}
+}
+
+func describeSize(field schemaField) string {
+	switch {
+	case field.precision != nil:
+		return "(" + strconv.FormatInt(*field.precision, 10) + "," + strconv.FormatInt(*field.scale, 10) + ")"
+	case field.length != nil:
+		return "(" + strconv.FormatInt(*field.length, 10) + ")"
+	}
+	return ""
+}
+
+// csvwName makes a column name usable as a CSVW name, which can't start
+// with an underscore and is used in URI templates.
+func csvwName(header string, i int) string {
+	name := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '/' || r == '#' || r == '?' || r == '{' || r == '}' {
+			return '_'
+		}
+		return r
+	}, header)
+	if name == "" || strings.HasPrefix(name, "_") {
+		return "column" + strconv.Itoa(i+1) + name
+	}
+	return name
+}
+
+// frictionlessName makes a lower case name of letters, digits, -, _ and .
+func frictionlessName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// goLayoutToStrftime converts a Go time layout to the strftime style
+// patterns Frictionless uses, failing on anything it can't express.
+func goLayoutToStrftime(layout string) (string, bool) {
+	return convertLayout(layout, []layoutToken{
+		{"Z07:00", "%z"}, {"-07:00", "%z"}, {"-0700", "%z"},
+		{"2006", "%Y"}, {"01", "%m"}, {"02", "%d"}, {"15", "%H"}, {"03", "%I"},
+		{"04", "%M"}, {"05", "%S"}, {"PM", "%p"}, {"Jan", "%b"}, {"Mon", "%a"},
+		{"MST", "%Z"}, {".000000", ".%f"},
+	}, func(literal string) string { return strings.ReplaceAll(literal, "%", "%%") })
+}
+
+// goLayoutToUnicode converts a Go time layout to the Unicode date field
+// patterns CSVW uses, failing on anything it can't express.
+func goLayoutToUnicode(layout string) (string, bool) {
+	return convertLayout(layout, []layoutToken{
+		{"Z07:00", "XXX"}, {"-07:00", "xxx"}, {"-0700", "xx"},
+		{"2006", "yyyy"}, {"01", "MM"}, {"02", "dd"}, {"15", "HH"},
+		{"04", "mm"}, {"05", "ss"}, {".000", ".SSS"},
+	}, func(literal string) string {
+		if literal == "T" {
+			return "'T'"
+		}
+		return literal
+	})
+}
+
+type layoutToken struct {
+	goToken, pattern string
+}
+
+// convertLayout swaps each Go layout token for its pattern, passing other
+// characters through quote. Letters and digits other than the T between
+// date and time are most likely tokens we don't handle, so they fail the
+// conversion.
+func convertLayout(layout string, tokens []layoutToken, quote func(string) string) (string, bool) {
+	var converted strings.Builder
+	for len(layout) > 0 {
+		matched := false
+		for _, token := range tokens {
+			if strings.HasPrefix(layout, token.goToken) {
+				converted.WriteString(token.pattern)
+				layout = layout[len(token.goToken):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		c := layout[0]
+		if c != 'T' && ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return "", false
+		}
+		converted.WriteString(quote(layout[:1]))
+		layout = layout[1:]
+	}
+	return converted.String(), true
+}
@@ -0,0 +1,183 @@
+package sqltocsv_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestWriteFileCSVWSchema(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+	converter.Schema = sqltocsv.SchemaCSVW
+	converter.TimeFormat = time.RFC3339
+	converter.Delimiter = ';'
+	converter.RenameColumns = map[string]string{"qty": "quantity"}
+
+	csvFileName := filepath.Join(t.TempDir(), "orders.csv")
+	if err := converter.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var metadata struct {
+		URL     string `json:"url"`
+		Dialect struct {
+			Delimiter string `json:"delimiter"`
+			Encoding  string `json:"encoding"`
+			Header    bool   `json:"header"`
+		} `json:"dialect"`
+		TableSchema struct {
+			Columns []struct {
+				Titles   string            `json:"titles"`
+				Datatype map[string]string `json:"datatype"`
+				Required bool              `json:"required"`
+			} `json:"columns"`
+			Null string `json:"null"`
+		} `json:"tableSchema"`
+	}
+	readJSON(t, csvFileName+"-metadata.json", &metadata)
+
+	if metadata.URL != "orders.csv" || metadata.Dialect.Delimiter != ";" || metadata.Dialect.Encoding != "utf-8" || !metadata.Dialect.Header {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+
+	var actual []string
+	for _, column := range metadata.TableSchema.Columns {
+		actual = append(actual, column.Titles+" "+column.Datatype["base"]+" "+column.Datatype["format"])
+	}
+	expected := []string{
+		"item string ",
+		"price decimal ",
+		"quantity integer ",
+		"placed datetime yyyy-MM-dd'T'HH:mm:ssXXX",
+		"country string ",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected columns %q, got %q", expected, actual)
+	}
+	if !metadata.TableSchema.Columns[0].Required || metadata.TableSchema.Columns[4].Required {
+		t.Error("expected item to be required and country not")
+	}
+}
+
+func TestWriteFileFrictionlessSchema(t *testing.T) {
+	converter := sqltocsv.New(getOrderTestRows(t))
+	converter.Schema = sqltocsv.SchemaFrictionless
+	converter.TimeFormat = "2006-01-02"
+	converter.MaskRules = []sqltocsv.MaskRule{{Column: "qty", Method: sqltocsv.MaskHash}}
+
+	csvFileName := filepath.Join(t.TempDir(), "Orders 2021.csv")
+	if err := converter.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var dataPackage struct {
+		Name      string `json:"name"`
+		Resources []struct {
+			Path   string `json:"path"`
+			Schema struct {
+				Fields []struct {
+					Name   string `json:"name"`
+					Type   string `json:"type"`
+					Format string `json:"format"`
+				} `json:"fields"`
+				MissingValues []string `json:"missingValues"`
+			} `json:"schema"`
+		} `json:"resources"`
+	}
+	readJSON(t, csvFileName+".datapackage.json", &dataPackage)
+
+	if dataPackage.Name != "orders_2021" || len(dataPackage.Resources) != 1 || dataPackage.Resources[0].Path != "Orders 2021.csv" {
+		t.Fatalf("unexpected data package %+v", dataPackage)
+	}
+	var actual []string
+	for _, field := range dataPackage.Resources[0].Schema.Fields {
+		actual = append(actual, field.Name+" "+field.Type+" "+field.Format)
+	}
+	expected := []string{
+		"item string ",
+		"price number ",
+		"qty string ",
+		"placed datetime %Y-%m-%d",
+		"country string ",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected fields %q, got %q", expected, actual)
+	}
+}
+
+func TestSchemaDescribesTypeHeadersAndComments(t *testing.T) {
+	dir := t.TempDir()
+	converter := sqltocsv.New(getOrderTestRows(t))
+	converter.Schema = sqltocsv.SchemaCSVW
+	converter.HeaderTypes = sqltocsv.HeaderTypesRow
+	converter.WriteComments = true
+	converter.Query = "SELECT *\nFROM orders"
+	if err := converter.WriteFile(filepath.Join(dir, "rows.csv")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var metadata struct {
+		Dialect struct {
+			HeaderRowCount int    `json:"headerRowCount"`
+			SkipRows       int    `json:"skipRows"`
+			CommentPrefix  string `json:"commentPrefix"`
+		} `json:"dialect"`
+		TableSchema struct {
+			Columns []struct {
+				Titles string `json:"titles"`
+			} `json:"columns"`
+		} `json:"tableSchema"`
+	}
+	readJSON(t, filepath.Join(dir, "rows.csv-metadata.json"), &metadata)
+	if metadata.Dialect.HeaderRowCount != 2 || metadata.Dialect.SkipRows != 3 || metadata.Dialect.CommentPrefix != "#" {
+		t.Errorf("unexpected dialect %+v", metadata.Dialect)
+	}
+
+	// inline types are in the header cells, but not part of the titles
+	converter = sqltocsv.New(getOrderTestRows(t))
+	converter.Schema = sqltocsv.SchemaCSVW
+	converter.HeaderTypes = sqltocsv.HeaderTypesInline
+	if err := converter.WriteFile(filepath.Join(dir, "inline.csv")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	readJSON(t, filepath.Join(dir, "inline.csv-metadata.json"), &metadata)
+	if metadata.Dialect.HeaderRowCount != 1 || metadata.TableSchema.Columns[0].Titles != "item" {
+		t.Errorf("unexpected metadata %+v", metadata)
+	}
+
+	converter = sqltocsv.New(getOrderTestRows(t))
+	converter.Schema = sqltocsv.SchemaFrictionless
+	converter.HeaderTypes = sqltocsv.HeaderTypesRow
+	converter.WriteComments = true
+	converter.CommentChar = ';'
+	if err := converter.WriteFile(filepath.Join(dir, "package.csv")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var dataPackage struct {
+		Resources []struct {
+			Dialect struct {
+				HeaderRows  []int  `json:"headerRows"`
+				CommentChar string `json:"commentChar"`
+			} `json:"dialect"`
+		} `json:"resources"`
+	}
+	readJSON(t, filepath.Join(dir, "package.csv.datapackage.json"), &dataPackage)
+	if dialect := dataPackage.Resources[0].Dialect; !reflect.DeepEqual(dialect.HeaderRows, []int{1, 2}) || dialect.CommentChar != ";" {
+		t.Errorf("unexpected dialect %+v", dialect)
+	}
+}
+
+func readJSON(t *testing.T, fileName string, v interface{}) {
+	encoded, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = json.Unmarshal(encoded, v); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package sqltocsv
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShardedExport exports one big table through several cursors at once,
+// each reading its own range of KeyColumn.
+//
+// Query is a template with {{lower}} and {{upper}} where the bounds of a
+// shard's range go, like
+//
+//	SELECT * FROM events WHERE id >= {{lower}} AND id < {{upper}} ORDER BY id
+//
+// and each shard runs it with its own bounds as query arguments. A shard
+// reads keys >= its lower bound and < its upper bound, so when Splits is
+// set it needs a boundary no more than the smallest key, one above the
+// largest, and any in between: n+1 boundaries for n shards.
+type ShardedExport struct {
+	DB        *sql.DB
+	Query     string
+	KeyColumn string
+	Table     string // table KeyColumn's MIN and MAX come from when Splits is empty
+
+	Shards      int                // number of ranges to split MIN to MAX into (default is 4)
+	Splits      []interface{}      // shard boundaries in key order, used instead of MIN and MAX (see above)
+	BoundsQuery string             // query returning the integer MIN and MAX of the key (default is SELECT MIN(KeyColumn), MAX(KeyColumn) FROM Table)
+	Connections int                // shards run at once (default is all of them)
+	Retries     int                // times a failed shard is tried again (default is 0)
+	Placeholder func(n int) string // query placeholder for the nth argument, counting from 1 (default is ?)
+	Configure   func(c *Converter) // sets up the Converter for each shard
+}
+
+// ShardError lists the shards that still failed after their retries.
+type ShardError struct {
+	Errors map[int]error // by shard number, counting from 0
+}
+
+func (e *ShardError) Error() string {
+	var messages []string
+	for shard := 0; len(messages) < len(e.Errors); shard++ {
+		if err, ok := e.Errors[shard]; ok {
+			messages = append(messages, fmt.Sprintf("shard %d: %v", shard, err))
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// WriteFiles writes each shard to its own file, named by formatting
+// fileNamePattern with the shard number, like "events-%03d.csv". It
+// returns the file names in key order.
+func (e ShardedExport) WriteFiles(fileNamePattern string) ([]string, error) {
+	bounds, err := e.bounds()
+	if err != nil {
+		return nil, err
+	}
+	fileNames := make([]string, len(bounds)-1)
+	for i := range fileNames {
+		fileNames[i] = fmt.Sprintf(fileNamePattern, i)
+	}
+
+	err = e.run(len(fileNames), func(shard int) error {
+		return e.export(bounds, shard, func(converter *Converter) error {
+			return converter.WriteFile(fileNames[shard])
+		})
+	})
+	return fileNames, err
+}
+
+// WriteFile writes every shard into one file in key order, with the
+// headers from the first. Each shard is written to a temporary file next
+// to csvFileName, and once all have succeeded they are joined into
+// another that is renamed over csvFileName, so a failure leaves any
+// existing file as it was. Sidecar files like WriteChecksum's are written
+// for the joined file, as set up by Configure for the first shard.
+func (e ShardedExport) WriteFile(csvFileName string) error {
+	started := time.Now()
+	bounds, err := e.bounds()
+	if err != nil {
+		return err
+	}
+	shards := len(bounds) - 1
+	parts := make([]string, shards)
+	partStats := make([]*writeStats, shards)
+	defer func() {
+		for _, part := range parts {
+			if part != "" {
+				os.Remove(part)
+			}
+		}
+	}()
+
+	var bomSize int
+	var first Converter
+	err = e.run(shards, func(shard int) error {
+		return e.export(bounds, shard, func(converter *Converter) error {
+			if converter.Encryption != nil {
+				return errors.New("encrypted shards can't be merged into one file")
+			}
+			if shard > 0 {
+				converter.WriteHeaders = false
+				converter.WriteComments = false
+			} else {
+				first = *converter
+				if converter.ExcelSafe {
+					bomSize = len(byteOrderMark(converter.Encoding))
+				}
+			}
+			if converter.WriteChecksum || converter.WriteManifest || converter.Schema != SchemaNone {
+				partStats[shard] = &writeStats{}
+				converter.stats = partStats[shard]
+			}
+
+			if parts[shard] != "" {
+				os.Remove(parts[shard]) // from a failed attempt
+			}
+			f, err := os.CreateTemp(filepath.Dir(csvFileName), ".sqltocsv-shard-*")
+			if err != nil {
+				return err
+			}
+			parts[shard] = f.Name()
+			if err = converter.Write(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// join into a staged file, so a failure leaves any earlier file alone
+	out, err := createStaged(csvFileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name()) // fails harmlessly once renamed
+	var w io.Writer = out
+	var stats *writeStats
+	if partStats[0] != nil {
+		// the sidecars describe the joined file, so hash it as it's joined
+		stats = &writeStats{started: started, sum: sha256.New(), columns: partStats[0].columns, fields: partStats[0].fields}
+		for _, part := range partStats {
+			if part != nil {
+				stats.rows += part.rows
+			}
+		}
+		w = io.MultiWriter(out, stats.sum, &countingWriter{n: &stats.bytes})
+	}
+	for shard, part := range parts {
+		skip := 0
+		if shard > 0 {
+			skip = bomSize // only the first part keeps its byte order mark
+		}
+		if err = appendFile(w, part, skip); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return first.commitFile(out.Name(), csvFileName, stats)
+}
+
+func appendFile(out io.Writer, fileName string, skip int) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Seek(int64(skip), io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	return err
+}
+
+// run calls export for each shard, at most Connections at a time, trying
+// failed shards again up to Retries times.
+func (e ShardedExport) run(shards int, export func(shard int) error) error {
+	connections := e.Connections
+	if connections <= 0 || connections > shards {
+		connections = shards
+	}
+	slots := make(chan struct{}, connections)
+
+	var mu sync.Mutex
+	failed := map[int]error{}
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var err error
+			for attempt := 0; attempt <= e.Retries; attempt++ {
+				if err = export(shard); err == nil {
+					return
+				}
+			}
+			mu.Lock()
+			failed[shard] = err
+			mu.Unlock()
+		}(shard)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &ShardError{Errors: failed}
+	}
+	return nil
+}
+
+// export queries shard and hands write a Converter for its rows.
+func (e ShardedExport) export(bounds []interface{}, shard int, write func(converter *Converter) error) error {
+	query, args := e.shardQuery(bounds[shard], bounds[shard+1])
+	rows, err := e.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	converter := New(rows)
+	if e.Configure != nil {
+		e.Configure(converter)
+	}
+	return write(converter)
+}
+
+// shardQuery fills in the {{lower}} and {{upper}} placeholders, returning
+// the bounds as arguments in the order they appear.
+func (e ShardedExport) shardQuery(lower, upper interface{}) (string, []interface{}) {
+	return bindQuery(e.Query, e.Placeholder, map[string]interface{}{"lower": lower, "upper": upper})
+}
+
+// bindQuery replaces each {{name}} in query with a placeholder (default
+// is ?), returning the named values as arguments in the order they
+// appear.
+func bindQuery(query string, placeholder func(n int) string, values map[string]interface{}) (string, []interface{}) {
+	if placeholder == nil {
+		placeholder = func(int) string { return "?" }
+	}
+
+	var bound strings.Builder
+	var args []interface{}
+	rest := query
+	for {
+		at, name := -1, ""
+		for candidate := range values {
+			i := strings.Index(rest, "{{"+candidate+"}}")
+			if i != -1 && (at == -1 || i < at) {
+				at, name = i, candidate
+			}
+		}
+		if at == -1 {
+			bound.WriteString(rest)
+			return bound.String(), args
+		}
+		args = append(args, values[name])
+		bound.WriteString(rest[:at])
+		bound.WriteString(placeholder(len(args)))
+		rest = rest[at+len("{{"+name+"}}"):]
+	}
+}
+
+// bounds returns the shard boundaries, from Splits or by splitting the
+// range from MIN to MAX of the key evenly.
+func (e ShardedExport) bounds() ([]interface{}, error) {
+	if len(e.Splits) > 0 {
+		if len(e.Splits) < 2 {
+			return nil, errors.New("Splits needs at least a lower and an upper bound")
+		}
+		return e.Splits, nil
+	}
+
+	boundsQuery := e.BoundsQuery
+	if boundsQuery == "" {
+		if e.Table == "" || e.KeyColumn == "" {
+			return nil, errors.New("ShardedExport needs Splits, a BoundsQuery, or a Table and KeyColumn")
+		}
+		boundsQuery = fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", e.KeyColumn, e.KeyColumn, e.Table)
+	}
+	var min, max sql.NullInt64
+	if err := e.DB.QueryRow(boundsQuery).Scan(&min, &max); err != nil {
+		return nil, fmt.Errorf("finding the key range: %w", err)
+	}
+	if !min.Valid || !max.Valid {
+		// an empty table still gets a file with headers
+		return []interface{}{int64(0), int64(0)}, nil
+	}
+
+	shards := e.Shards
+	if shards <= 0 {
+		shards = 4
+	}
+	return splitRange(min.Int64, max.Int64, shards), nil
+}
+
+// splitRange splits the keys from lower to max into at most shards
+// ranges of the same size, returning their boundaries. The arithmetic is
+// done in uint64 as the range can be wider than an int64 holds, and when
+// max is the largest int64 the last boundary is one above it as a uint64,
+// which the driver has to accept.
+func splitRange(lower, max int64, shards int) []interface{} {
+	// ceil((span+1) / shards), without overflowing when span is the
+	// whole of int64
+	span := uint64(max) - uint64(lower)
+	size := span/uint64(shards) + 1
+	bounds := []interface{}{lower}
+	for i := uint64(1); i < uint64(shards) && i*size <= span; i++ {
+		bounds = append(bounds, int64(uint64(lower)+i*size))
+	}
+	if max == math.MaxInt64 {
+		return append(bounds, uint64(max)+1)
+	}
+	return append(bounds, max+1)
+}
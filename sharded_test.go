@@ -0,0 +1,194 @@
+package sqltocsv_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestShardedExportMergedFile(t *testing.T) {
+	db := setupEventsDatabase(t, 100)
+
+	export := sqltocsv.ShardedExport{
+		DB:          db,
+		Query:       "SELECT|events|count,name|count>={{lower}},count<{{upper}}",
+		Splits:      []interface{}{int64(0), int64(10), int64(55), int64(100)},
+		Connections: 2,
+	}
+	csvFileName := filepath.Join(t.TempDir(), "events.csv")
+	if err := export.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "count,name\n"
+	for i := 0; i < 100; i++ {
+		expected += strconv.Itoa(i) + ",event\n"
+	}
+	actual, _ := os.ReadFile(csvFileName)
+	assertCsvMatch(t, expected, string(actual))
+
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(csvFileName), ".sqltocsv-shard-*"))
+	if len(leftovers) > 0 {
+		t.Errorf("expected the shard parts to be removed, found %v", leftovers)
+	}
+}
+
+func TestShardedExportFailureKeepsExistingFile(t *testing.T) {
+	db := setupEventsDatabase(t, 10)
+	dir := t.TempDir()
+	csvFileName := filepath.Join(dir, "events.csv")
+	os.WriteFile(csvFileName, []byte("count\nyesterday\n"), 0644)
+
+	export := sqltocsv.ShardedExport{
+		DB:     db,
+		Query:  "SELECT|events|count|count>={{lower}},count<{{upper}}",
+		Splits: []interface{}{int64(0), int64(5), int64(10)},
+		Configure: func(c *sqltocsv.Converter) {
+			c.Columns = []string{"missing"}
+		},
+	}
+	if err := export.WriteFile(csvFileName); err == nil {
+		t.Fatal("expected an error")
+	}
+	actual, _ := os.ReadFile(csvFileName)
+	assertCsvMatch(t, "count\nyesterday\n", string(actual))
+
+	// the joined file can't be renamed over a directory
+	export.Configure = nil
+	os.Mkdir(filepath.Join(dir, "taken.csv"), 0755)
+	os.WriteFile(filepath.Join(dir, "taken.csv", "keep"), nil, 0644)
+	if err := export.WriteFile(filepath.Join(dir, "taken.csv")); err == nil {
+		t.Fatal("expected an error renaming over a directory")
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("expected only events.csv and taken.csv, found %v", files)
+	}
+}
+
+func TestShardedExportFilesFromBounds(t *testing.T) {
+	db := setupEventsDatabase(t, 10)
+	exec(t, db, "CREATE|bounds|lo=int64,hi=int64")
+	exec(t, db, "INSERT|bounds|lo=?,hi=?", int64(0), int64(9))
+
+	export := sqltocsv.ShardedExport{
+		DB:          db,
+		Query:       "SELECT|events|count|count>={{lower}},count<{{upper}}",
+		BoundsQuery: "SELECT|bounds|lo,hi|",
+		Shards:      3,
+	}
+	pattern := filepath.Join(t.TempDir(), "events-%d.csv")
+	fileNames, err := export.WriteFiles(pattern)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := []string{"count\n0\n1\n2\n3\n", "count\n4\n5\n6\n7\n", "count\n8\n9\n"}
+	if len(fileNames) != len(expected) {
+		t.Fatalf("expected %d files, got %v", len(expected), fileNames)
+	}
+	for i, fileName := range fileNames {
+		actual, _ := os.ReadFile(fileName)
+		assertCsvMatch(t, expected[i], string(actual))
+	}
+}
+
+func TestShardedExportRetriesFailedShards(t *testing.T) {
+	db := setupEventsDatabase(t, 10)
+
+	var mu sync.Mutex
+	attempts := 0
+	export := sqltocsv.ShardedExport{
+		DB:     db,
+		Query:  "SELECT|events|count|count>={{lower}},count<{{upper}}",
+		Splits: []interface{}{int64(0), int64(5), int64(10)},
+		Configure: func(c *sqltocsv.Converter) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts == 1 {
+				c.Columns = []string{"missing"}
+			}
+		},
+	}
+	csvFileName := filepath.Join(t.TempDir(), "events.csv")
+
+	if err := export.WriteFile(csvFileName); err == nil {
+		t.Fatal("expected an error without retries")
+	} else if shardErr, ok := err.(*sqltocsv.ShardError); !ok || len(shardErr.Errors) != 1 {
+		t.Fatalf("expected a ShardError for one shard, got %v", err)
+	}
+
+	attempts = 0
+	export.Retries = 1
+	if err := export.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	actual, _ := os.ReadFile(csvFileName)
+	assertCsvMatch(t, "count\n0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n", string(actual))
+}
+
+func TestShardedExportWideKeyRange(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|hashed|id=int64")
+	for _, id := range []int64{-5e18, 0, 5e18} {
+		exec(t, db, "INSERT|hashed|id=?", id)
+	}
+	exec(t, db, "CREATE|bounds|lo=int64,hi=int64")
+	exec(t, db, "INSERT|bounds|lo=?,hi=?", int64(-5e18), int64(5e18))
+
+	export := sqltocsv.ShardedExport{
+		DB:          db,
+		Query:       "SELECT|hashed|id|id>={{lower}},id<{{upper}}",
+		BoundsQuery: "SELECT|bounds|lo,hi|",
+		Configure:   func(c *sqltocsv.Converter) { c.WriteManifest = true },
+	}
+	csvFileName := filepath.Join(t.TempDir(), "hashed.csv")
+	if err := export.WriteFile(csvFileName); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	actual, _ := os.ReadFile(csvFileName)
+	assertCsvMatch(t, "id\n-5000000000000000000\n0\n5000000000000000000\n", string(actual))
+
+	// the manifest describes the joined file, not the first shard
+	var manifest sqltocsv.Manifest
+	encoded, err := os.ReadFile(csvFileName + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(encoded, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(actual)
+	if manifest.Rows != 3 || manifest.Bytes != int64(len(actual)) || manifest.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+}
+
+func TestShardedExportKeysUpToMaxInt64(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|bounds|lo=int64,hi=int64")
+	exec(t, db, "INSERT|bounds|lo=?,hi=?", int64(0), int64(math.MaxInt64))
+
+	export := sqltocsv.ShardedExport{
+		DB:          db,
+		Query:       "SELECT|bounds|lo|lo>={{lower}},lo<{{upper}}",
+		BoundsQuery: "SELECT|bounds|lo,hi|",
+	}
+	_, err := export.WriteFiles(filepath.Join(t.TempDir(), "bounds-%d.csv"))
+
+	// only the last shard's bound is above every int64, which the fake
+	// driver can't take as an argument
+	shardErr, ok := err.(*sqltocsv.ShardError)
+	if !ok || len(shardErr.Errors) != 1 || shardErr.Errors[3] == nil {
+		t.Fatalf("expected only the last of 4 shards to fail, got %v", err)
+	}
+}
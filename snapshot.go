@@ -0,0 +1,93 @@
+package sqltocsv
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot exports several related queries, like orders and their
+// order_items, from one read-only transaction so the files agree with
+// each other even while the tables are being written to.
+//
+// How consistent the view is depends on the isolation level: at the
+// READ COMMITTED default of databases like PostgreSQL each query still
+// sees the latest commits, so ask for sql.LevelRepeatableRead (or
+// sql.LevelSnapshot on SQL Server) in TxOptions.
+type Snapshot struct {
+	DB        *sql.DB
+	Dir       string
+	Jobs      []BatchJob
+	TxOptions sql.TxOptions // isolation level for the transaction, which is always read-only (default is the driver's)
+}
+
+// Run runs the jobs one after another in the transaction, each into its
+// own file in Dir as for a Batch. The files are only renamed into place
+// once every job has succeeded, so a job that fails leaves none of them
+// behind. The renames themselves aren't all or nothing: if one fails, the
+// files of the jobs before it have already replaced any older ones, and
+// the error says which they are.
+func (s Snapshot) Run(ctx context.Context) ([]BatchResult, error) {
+	if err := checkJobNames(s.Jobs); err != nil {
+		return nil, err
+	}
+	options := s.TxOptions
+	options.ReadOnly = true
+	tx, err := s.DB.BeginTx(ctx, &options)
+	if err != nil {
+		return nil, fmt.Errorf("starting the snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(s.Jobs))
+	converters := make([]*Converter, len(s.Jobs))
+	stats := make([]*writeStats, len(s.Jobs))
+	staged := make([]string, len(s.Jobs))
+	defer func() {
+		for _, fileName := range staged {
+			if fileName != "" {
+				os.Remove(fileName) // fails harmlessly once renamed
+			}
+		}
+	}()
+
+	for i, job := range s.Jobs {
+		started := time.Now()
+		results[i] = BatchResult{
+			Name: job.Name,
+			File: filepath.Join(s.Dir, job.Name+".csv"),
+		}
+		stats[i] = &writeStats{}
+		err = runJob(ctx, tx, job, func(converter *Converter) error {
+			converters[i] = converter
+			var err error
+			staged[i], err = converter.stageFile(results[i].File, stats[i])
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("job %q: %w", job.Name, err)
+		}
+		results[i].Rows = stats[i].rows
+		results[i].Bytes = stats[i].bytes
+		results[i].SHA256 = hex.EncodeToString(stats[i].sum.Sum(nil))
+		results[i].Duration = time.Since(started)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ending the snapshot: %w", err)
+	}
+	for i := range s.Jobs {
+		if err = converters[i].commitFile(staged[i], results[i].File, stats[i]); err != nil {
+			var committed []string
+			for _, job := range s.Jobs[:i] {
+				committed = append(committed, job.Name)
+			}
+			return nil, fmt.Errorf("job %q: %w (the files of %s are already in place)", s.Jobs[i].Name, err, committed)
+		}
+	}
+	return results, nil
+}
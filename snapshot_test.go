@@ -0,0 +1,111 @@
+package sqltocsv_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joho/sqltocsv"
+)
+
+func TestSnapshotRun(t *testing.T) {
+	db := setupDatabase(t)
+	dir := t.TempDir()
+
+	snapshot := sqltocsv.Snapshot{
+		DB:  db,
+		Dir: dir,
+		Jobs: []sqltocsv.BatchJob{
+			{Name: "names", Query: "SELECT|people|name|"},
+			{Name: "ages", Query: "SELECT|people|age|"},
+		},
+		TxOptions: sql.TxOptions{Isolation: sql.LevelRepeatableRead},
+	}
+	results, err := snapshot.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	options := sqltocsv.FakeTxOptions("foo")
+	if !options.ReadOnly || sql.IsolationLevel(options.Isolation) != sql.LevelRepeatableRead {
+		t.Errorf("expected a read-only repeatable read transaction, got %+v", options)
+	}
+
+	if len(results) != 2 || results[0].Rows != 1 || results[1].Name != "ages" {
+		t.Errorf("unexpected results %+v", results)
+	}
+	actual, _ := os.ReadFile(filepath.Join(dir, "names.csv"))
+	assertCsvMatch(t, "name\nAlice\n", string(actual))
+	actual, _ = os.ReadFile(filepath.Join(dir, "ages.csv"))
+	assertCsvMatch(t, "age\n1\n", string(actual))
+
+	// the connection is back in the pool once the transaction is over
+	exec(t, db, "INSERT|people|name=Bob,age=2")
+}
+
+func TestSnapshotRunFailureLeavesNoFiles(t *testing.T) {
+	db := setupDatabase(t)
+	dir := t.TempDir()
+
+	snapshot := sqltocsv.Snapshot{
+		DB:  db,
+		Dir: dir,
+		Jobs: []sqltocsv.BatchJob{
+			{Name: "names", Query: "SELECT|people|name|"},
+			{Name: "broken", Query: "SELECT|nope|name|"},
+		},
+	}
+	results, err := snapshot.Run(context.Background())
+	if err == nil || results != nil {
+		t.Fatalf("expected an error and no results, got %v and %+v", err, results)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(files)+len(leftovers) > 0 {
+		t.Errorf("expected no files, found %v %v", files, leftovers)
+	}
+}
+
+func TestSnapshotRunFailedRenameReportsCommittedFiles(t *testing.T) {
+	db := setupDatabase(t)
+	dir := t.TempDir()
+	// ages.csv can't be renamed over a directory
+	os.Mkdir(filepath.Join(dir, "ages.csv"), 0755)
+	os.WriteFile(filepath.Join(dir, "ages.csv", "keep"), nil, 0644)
+
+	snapshot := sqltocsv.Snapshot{
+		DB:  db,
+		Dir: dir,
+		Jobs: []sqltocsv.BatchJob{
+			{Name: "names", Query: "SELECT|people|name|"},
+			{Name: "ages", Query: "SELECT|people|age|"},
+		},
+	}
+	_, err := snapshot.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "the files of [names] are already in place") {
+		t.Fatalf("expected the error to name the committed files, got %v", err)
+	}
+	actual, _ := os.ReadFile(filepath.Join(dir, "names.csv"))
+	assertCsvMatch(t, "name\nAlice\n", string(actual))
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".*")); len(leftovers) > 0 {
+		t.Errorf("expected the staged file to be removed, found %v", leftovers)
+	}
+}
+
+func TestSnapshotRunUnsupportedIsolation(t *testing.T) {
+	db := setupDatabase(t)
+
+	snapshot := sqltocsv.Snapshot{
+		DB:        db,
+		Dir:       t.TempDir(),
+		Jobs:      []sqltocsv.BatchJob{{Name: "names", Query: "SELECT|people|name|"}},
+		TxOptions: sql.TxOptions{Isolation: sql.LevelLinearizable},
+	}
+	if _, err := snapshot.Run(context.Background()); err == nil {
+		t.Error("expected an error for an isolation level the driver doesn't support")
+	}
+}
@@ -0,0 +1,218 @@
+package sqltocsv
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SortKey is a column for Converter to sort rows by.
+type SortKey struct {
+	Column     string // column name, or header when renamed
+	Descending bool
+	Collation  Collation // how text values compare (default is CollateBinary)
+}
+
+// Collation is how a SortKey compares text.
+type Collation int
+
+const (
+	// CollateBinary compares text byte by byte, so Z sorts before a
+	CollateBinary Collation = iota
+	// CollateNoCase compares text ignoring case
+	CollateNoCase
+	// CollateNatural compares runs of digits by their number, so file2
+	// sorts before file10, and the rest ignoring case
+	CollateNatural
+)
+
+// sortColumn is a SortKey resolved against the columns being written.
+type sortColumn struct {
+	SortKey
+	index  int
+	kind   string // integer, number, time or text
+	layout string // for time
+}
+
+// newRowSorter sets up sorting of the written rows by c.Sort. Numbers
+// and times compare by value, going by the columns' database types.
+// Empty cells sort first, and cells that don't parse as the column's
+// type sort after those that do.
+func (c Converter) newRowSorter(fields []schemaField, outputColumnNames []string) (*externalSorter, error) {
+	columns := make([]sortColumn, len(c.Sort))
+	for i, key := range c.Sort {
+		columns[i] = sortColumn{SortKey: key, index: -1, kind: "text"}
+		for n, name := range outputColumnNames {
+			if name == key.Column || (n < len(fields) && fields[n].name == key.Column) {
+				columns[i].index = n
+				break
+			}
+		}
+		if columns[i].index == -1 {
+			return nil, fmt.Errorf("can't sort by %s, it isn't one of the columns written", key.Column)
+		}
+		if n := columns[i].index; n < len(fields) {
+			switch fields[n].kind {
+			case "integer", "number":
+				columns[i].kind = fields[n].kind
+			case "date", "time", "datetime":
+				columns[i].kind, columns[i].layout = "time", fields[n].format
+			}
+		}
+	}
+
+	less := func(a, b []string) bool {
+		for _, column := range columns {
+			order := column.compare(cell(a, column.index), cell(b, column.index))
+			if column.Descending {
+				order = -order
+			}
+			if order != 0 {
+				return order < 0
+			}
+		}
+		return false
+	}
+	return newExternalSorter(less, c.SortMemory, c.SortTempDir), nil
+}
+
+// writeSorted hands the sorted rows to writeRow.
+func writeSorted(sorter *externalSorter, writeRow func([]string) error) error {
+	sorted, err := sorter.sorted()
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+	for {
+		row, err := sorted.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = writeRow(row); err != nil {
+			return err
+		}
+	}
+}
+
+func cell(row []string, i int) string {
+	if i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+func (column sortColumn) compare(a, b string) int {
+	if a == "" || b == "" {
+		return compareOrdered(a != "", b != "")
+	}
+
+	switch column.kind {
+	case "integer":
+		// exactly, as bigints past 2^53 don't survive a float64
+		if order, ok := compareIntegers(a, b); ok {
+			return order
+		}
+		fallthrough
+	case "number":
+		af, aErr := strconv.ParseFloat(a, 64)
+		bf, bErr := strconv.ParseFloat(b, 64)
+		if aErr == nil && bErr == nil {
+			return compareOrdered(af > bf, af < bf)
+		}
+		if aErr == nil || bErr == nil {
+			return compareOrdered(aErr != nil, bErr != nil)
+		}
+	case "time":
+		at, aErr := time.Parse(column.layout, a)
+		bt, bErr := time.Parse(column.layout, b)
+		if aErr == nil && bErr == nil {
+			return compareOrdered(at.After(bt), at.Before(bt))
+		}
+		if aErr == nil || bErr == nil {
+			return compareOrdered(aErr != nil, bErr != nil)
+		}
+	}
+	return collate(column.Collation, a, b)
+}
+
+// compareIntegers compares two integers written in base 10, reporting
+// false if either isn't one.
+func compareIntegers(a, b string) (int, bool) {
+	ai, aErr := strconv.ParseInt(a, 10, 64)
+	bi, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		return compareOrdered(ai > bi, ai < bi), true
+	}
+	// past int64, as unsigned bigints can be
+	ab, aOk := new(big.Int).SetString(a, 10)
+	bb, bOk := new(big.Int).SetString(b, 10)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	return ab.Cmp(bb), true
+}
+
+// compareOrdered returns 1 if greater, -1 if less and 0 otherwise.
+func compareOrdered(greater, less bool) int {
+	switch {
+	case greater:
+		return 1
+	case less:
+		return -1
+	}
+	return 0
+}
+
+// collate compares text by collation, falling back to comparing bytes so
+// only identical text is equal.
+func collate(collation Collation, a, b string) int {
+	switch collation {
+	case CollateNoCase:
+		if order := strings.Compare(strings.ToLower(a), strings.ToLower(b)); order != 0 {
+			return order
+		}
+	case CollateNatural:
+		if order := compareNatural(strings.ToLower(a), strings.ToLower(b)); order != 0 {
+			return order
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// compareNatural compares runs of digits by their value and the rest byte
+// by byte.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		aDigits, bDigits := digitRun(a), digitRun(b)
+		if aDigits > 0 && bDigits > 0 {
+			aNumber := strings.TrimLeft(a[:aDigits], "0")
+			bNumber := strings.TrimLeft(b[:bDigits], "0")
+			if len(aNumber) != len(bNumber) {
+				return compareOrdered(len(aNumber) > len(bNumber), len(aNumber) < len(bNumber))
+			}
+			if order := strings.Compare(aNumber, bNumber); order != 0 {
+				return order
+			}
+			a, b = a[aDigits:], b[bDigits:]
+			continue
+		}
+		if a[0] != b[0] {
+			return compareOrdered(a[0] > b[0], a[0] < b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return compareOrdered(a != "", b != "")
+}
+
+func digitRun(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
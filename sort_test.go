@@ -0,0 +1,180 @@
+package sqltocsv_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joho/sqltocsv"
+)
+
+func sortedCsv(t *testing.T, converter *sqltocsv.Converter) string {
+	var buf bytes.Buffer
+	if err := converter.Write(&buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return buf.String()
+}
+
+func TestSortNumbers(t *testing.T) {
+	db := setupEventsDatabase(t, 12)
+	converter := sqltocsv.New(queryRows(t, db, "SELECT|events|count,score|"))
+	converter.FloatFormat = "%.1f"
+	converter.Sort = []sqltocsv.SortKey{{Column: "count", Descending: true}}
+	assertCsvMatch(t, "count,score\n11,1.6\n10,1.4\n9,1.3\n8,1.1\n7,1.0\n6,0.9\n5,0.7\n4,0.6\n3,0.4\n2,0.3\n1,0.1\n0,0.0\n", sortedCsv(t, converter))
+
+	// formatted floats still sort as numbers
+	converter = sqltocsv.New(queryRows(t, db, "SELECT|events|score|"))
+	converter.FloatFormat = "%.2f"
+	converter.Sort = []sqltocsv.SortKey{{Column: "score", Descending: true}}
+	if actual := sortedCsv(t, converter); !strings.HasPrefix(actual, "score\n1.57\n1.43\n1.29\n") {
+		t.Errorf("expected scores in numeric order, got\n%s", actual)
+	}
+}
+
+func TestSortBigintsExactly(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|big|id=int64")
+	for _, id := range []int64{9007199254740993, 9007199254740992, 9007199254740994, 9007199254740995, -9007199254740993} {
+		exec(t, db, "INSERT|big|id=?", id)
+	}
+
+	converter := sqltocsv.New(queryRows(t, db, "SELECT|big|id|"))
+	converter.Sort = []sqltocsv.SortKey{{Column: "id"}}
+	assertCsvMatch(t, "id\n-9007199254740993\n9007199254740992\n9007199254740993\n9007199254740994\n9007199254740995\n", sortedCsv(t, converter))
+
+	converter = sqltocsv.New(queryRows(t, db, "SELECT|big|id|"))
+	converter.Sort = []sqltocsv.SortKey{{Column: "id", Descending: true}}
+	assertCsvMatch(t, "id\n9007199254740995\n9007199254740994\n9007199254740993\n9007199254740992\n-9007199254740993\n", sortedCsv(t, converter))
+}
+
+func TestSortTimesAndMultipleKeys(t *testing.T) {
+	db := setupEventsDatabase(t, 4)
+	exec(t, db, "INSERT|events|name=another,count=?,at=?", int64(9), time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	converter := sqltocsv.New(queryRows(t, db, "SELECT|events|name,count,at|"))
+	converter.TimeFormat = "2 Jan 2006 15:04:05"
+	converter.Sort = []sqltocsv.SortKey{{Column: "at"}}
+	assertCsvMatch(t, `name,count,at
+another,9,1 Jun 2019 00:00:00
+event,0,1 Jan 2020 00:00:00
+event,1,1 Jan 2020 00:00:01
+event,2,1 Jan 2020 00:00:02
+event,3,1 Jan 2020 00:00:03
+`, sortedCsv(t, converter))
+
+	converter = sqltocsv.New(queryRows(t, db, "SELECT|events|name,count|"))
+	converter.RenameColumns = map[string]string{"count": "n"}
+	converter.Sort = []sqltocsv.SortKey{{Column: "name", Descending: true}, {Column: "n", Descending: true}}
+	assertCsvMatch(t, "name,n\nevent,3\nevent,2\nevent,1\nevent,0\nanother,9\n", sortedCsv(t, converter))
+}
+
+func TestSortCollations(t *testing.T) {
+	db := setupDatabase(t)
+	exec(t, db, "CREATE|words|word=string")
+	for _, word := range []string{"file10", "File2", "file1", "apple", "Banana", ""} {
+		exec(t, db, "INSERT|words|word=?", word)
+	}
+
+	for _, test := range []struct {
+		collation sqltocsv.Collation
+		expected  string
+	}{
+		{sqltocsv.CollateBinary, "word\n\nBanana\nFile2\napple\nfile1\nfile10\n"},
+		{sqltocsv.CollateNoCase, "word\n\napple\nBanana\nfile1\nfile10\nFile2\n"},
+		{sqltocsv.CollateNatural, "word\n\napple\nBanana\nfile1\nFile2\nfile10\n"},
+	} {
+		converter := sqltocsv.New(queryRows(t, db, "SELECT|words|word|"))
+		converter.Sort = []sqltocsv.SortKey{{Column: "word", Collation: test.collation}}
+		assertCsvMatch(t, test.expected, sortedCsv(t, converter))
+	}
+}
+
+func TestSortOnDisk(t *testing.T) {
+	db := setupEventsDatabase(t, 500)
+	dir := t.TempDir()
+
+	inMemory := sqltocsv.New(queryRows(t, db, "SELECT|events|count,name,note|"))
+	inMemory.Sort = []sqltocsv.SortKey{{Column: "note"}, {Column: "count", Descending: true}}
+	expected := sortedCsv(t, inMemory)
+
+	onDisk := sqltocsv.New(queryRows(t, db, "SELECT|events|count,name,note|"))
+	onDisk.Sort = inMemory.Sort
+	onDisk.SortMemory = 1000
+	onDisk.SortTempDir = dir
+	onDisk.Concurrency = 4
+	assertCsvMatch(t, expected, sortedCsv(t, onDisk))
+
+	if !strings.HasPrefix(expected, "count,name,note\n499,event,\n") {
+		t.Errorf("expected empty notes first, got\n%s", expected[:100])
+	}
+	runs, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(runs) > 0 {
+		t.Errorf("expected sorted runs to be removed, found %d", len(runs))
+	}
+}
+
+// runSpy looks through the sorted runs in dir the first time output is
+// written while they're there.
+type runSpy struct {
+	bytes.Buffer
+	dir       string
+	runs      int
+	plaintext bool
+}
+
+func (w *runSpy) Write(p []byte) (int, error) {
+	if w.runs == 0 {
+		runs, _ := filepath.Glob(filepath.Join(w.dir, "*"))
+		for _, run := range runs {
+			contents, _ := os.ReadFile(run)
+			w.plaintext = w.plaintext || bytes.Contains(contents, []byte("a note with"))
+		}
+		w.runs = len(runs)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSortOnDiskEncrypted(t *testing.T) {
+	db := setupEventsDatabase(t, 8000)
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inMemory := sqltocsv.New(queryRows(t, db, "SELECT|events|count,note|"))
+	inMemory.Sort = []sqltocsv.SortKey{{Column: "note"}, {Column: "count", Descending: true}}
+	expected := sortedCsv(t, inMemory)
+
+	// more runs than are merged at once, so they take several passes
+	onDisk := sqltocsv.New(queryRows(t, db, "SELECT|events|count,note|"))
+	onDisk.Sort = inMemory.Sort
+	onDisk.SortMemory = 500
+	onDisk.SortTempDir = t.TempDir()
+	onDisk.Encryption = &sqltocsv.Encryption{Recipient: identity.PublicKey()}
+	spy := &runSpy{dir: onDisk.SortTempDir}
+	if err = onDisk.Write(spy); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	assertCsvMatch(t, expected, decrypt(t, spy.Bytes(), sqltocsv.Encryption{Identity: identity}))
+
+	if spy.runs == 0 || spy.runs > 64 {
+		t.Errorf("expected the runs to be merged down to at most 64, found %d", spy.runs)
+	}
+	if spy.plaintext {
+		t.Error("expected the sorted runs to be encrypted")
+	}
+}
+
+func TestSortUnknownColumn(t *testing.T) {
+	converter := getConverter(t)
+	converter.Sort = []sqltocsv.SortKey{{Column: "height"}}
+	if err := converter.Write(&bytes.Buffer{}); err == nil {
+		t.Error("expected an error sorting by a column that isn't written")
+	}
+}
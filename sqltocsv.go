@@ -6,11 +6,16 @@ package sqltocsv
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
@@ -39,8 +44,19 @@ func Write(writer io.Writer, rows *sql.Rows) error {
 //
 // Return an outputRow of false if you want the row skipped otherwise
 // return the processed Row slice as you want it written to the CSV.
+//
+// The row slice is reused for the next row, so copy it if you need to
+// hold on to it after returning.
 type CsvPreProcessorFunc func(row []string, columnNames []string) (outputRow bool, processedRow []string)
 
+// CsvRowProcessorFunc is a function type for processing your CSV which,
+// unlike CsvPreProcessorFunc, can turn one row into any number of rows.
+//
+// Return no rows to skip the row, the row itself to keep it, or several
+// rows to split it up or insert extra lines (like subtotals) after it.
+// As with CsvPreProcessorFunc, copy the row if you keep it past the call.
+type CsvRowProcessorFunc func(row []string, columnNames []string) (outputRows [][]string)
+
 // Converter does the actual work of converting the rows to CSV.
 // There are a few settings you can override if you want to do
 // some fancy stuff to your CSV.
@@ -50,16 +66,115 @@ type Converter struct {
 	TimeFormat   string   // Format string for any time.Time values (default is time's default)
 	FloatFormat  string   // Format string for any float64 and float32 values (default is %v)
 	Delimiter    rune     // Delimiter to use in your CSV (default is comma)
+	UseCRLF      bool     // End lines with \r\n rather than \n (default is false)
+
+	Columns       []string          // Names of the columns to write, in order (default is all of them)
+	RenameColumns map[string]string // Header to write for a column, keyed by column name
+
+	StrictWidth      bool                  // Error if any row doesn't have one column per header (default is false)
+	DuplicateColumns DuplicateColumnPolicy // What to do when the query returns two columns with the same name (default is write both)
+	ColumnTables     []string              // Table name for each query column, used by DuplicatePrefixTable
+
+	ExcelSafe            bool     // Write a byte order mark and escape formula-like cells for Excel (default is false)
+	PreserveLeadingZeros bool     // With ExcelSafe, write numbers like 00123 as ="00123" so Excel keeps the zeros
+	ExcelSafeExempt      []string // Column names ExcelSafe should leave untouched
+
+	Encoding        Encoding              // Character encoding to write the CSV in (default is UTF-8)
+	Unrepresentable UnrepresentablePolicy // What to do with characters Encoding can't represent (default is an error)
+	InvalidUTF8     InvalidUTF8Policy     // What to do with invalid UTF-8 in []byte columns (default is pass it through)
+
+	BinaryEncoding BinaryEncoding // How to write binary columns like BLOB and bytea (default is raw bytes)
+
+	JSONColumns    []string            // Columns to treat as JSON as well as those typed json or jsonb
+	JSONFormat     JSONFormat          // How to write JSON columns (default is as the database sent them)
+	FlattenJSON    []string            // JSON object columns to split into one column.key column per key
+	FlattenKeys    map[string][]string // Keys to write for a FlattenJSON column (default is discover them from the data)
+	FlattenSample  int                 // How many rows to read when discovering FlattenJSON keys (default is 100)
+	ArrayColumns   []string            // Columns to treat as arrays as well as those the driver reports as arrays
+	ArrayMode      ArrayMode           // How to write array columns (default is as the database sent them)
+	ArraySeparator string              // Separator used by ArrayJoin (default is ;)
+
+	ComputedColumns []ComputedColumn // Extra columns calculated from each row, added after the query's columns
+	Filter          string           // Only write rows matching this predicate, like "age >= 18 AND country IN ('NZ', 'AU')"
+
+	MaskRules  []MaskRule     // Rules for masking personal data, by column name or pattern
+	PIIWarning PIIWarningFunc // Called when an unmasked column looks like it holds emails or card numbers
+
+	Policy      *Policy   // Column access policy enforced for Role (default is no policy)
+	Role        string    // Role whose RolePolicy applies when Policy is set
+	PolicyAudit AuditFunc // Called with an AuditRecord for each export made under Policy
+
+	Encryption *Encryption // Encrypts the output with AES-256-GCM (default is no encryption)
+
+	WriteChecksum bool               // WriteFile also writes a sha256sum style .sha256 file (default is false)
+	WriteManifest bool               // WriteFile also writes a .manifest.json describing the file (default is false)
+	Query         string             // Query to fingerprint in the manifest (optional)
+	SigningKey    ed25519.PrivateKey // Signs the manifest into .manifest.json.sig (optional)
+	Schema        SchemaFormat       // WriteFile also writes a CSVW or Frictionless schema (default is SchemaNone)
+
+	HeaderTypes   HeaderTypes // Adds database types to the headers, inline or as a second row (default is HeaderTypesNone)
+	WriteComments bool        // Starts the CSV with comment lines giving the generation time and Query (default is false)
+	CommentChar   rune        // Starts each comment line (default is #)
+
+	// Formats rows on this many goroutines while another reads them, writing
+	// them in the original order (default is 0, formatting as rows are read).
+	// Row processors must be safe to call concurrently.
+	Concurrency int
+
+	Sort        []SortKey // Sorts the rows by these columns, on disk if they don't fit in SortMemory (default is the order they're read in)
+	SortMemory  int       // Bytes of rows to sort in memory before spilling sorted runs to temporary files (default is 64MiB)
+	SortTempDir string    // Where Sort's temporary files go, encrypted when Encryption is set (default is os.TempDir())
 
 	rows            *sql.Rows
+	stats           *writeStats
+	onScan          func(values []interface{}) (bool, error) // sees each row as scanned, before Filter, and drops it if false
+	encryptSortRuns bool                                     // set while writing with Encryption
 	rowPreProcessor CsvPreProcessorFunc
+	rowProcessors   []CsvRowProcessorFunc
 }
 
-// SetRowPreProcessor lets you specify a CsvPreprocessorFunc for this conversion
+// SetRowPreProcessor lets you specify a CsvPreprocessorFunc for this conversion.
+// It always runs first, before anything added with AddRowProcessor.
 func (c *Converter) SetRowPreProcessor(processor CsvPreProcessorFunc) {
 	c.rowPreProcessor = processor
 }
 
+// AddRowProcessor appends a CsvRowProcessorFunc to the chain of processors
+// for this conversion. Processors run in the order they were added, each
+// one seeing every row the one before it returned.
+func (c *Converter) AddRowProcessor(processor CsvRowProcessorFunc) {
+	c.rowProcessors = append(c.rowProcessors, processor)
+}
+
+// processorChain returns the row processors to run, with the
+// SetRowPreProcessor one adapted to go first.
+func (c Converter) processorChain() []CsvRowProcessorFunc {
+	if c.rowPreProcessor == nil {
+		return c.rowProcessors
+	}
+	preProcessor := c.rowPreProcessor
+	adapted := func(row []string, columnNames []string) [][]string {
+		if writeRow, row := preProcessor(row, columnNames); writeRow {
+			return [][]string{row}
+		}
+		return nil
+	}
+	return append([]CsvRowProcessorFunc{adapted}, c.rowProcessors...)
+}
+
+// processRow runs row through every processor in chain.
+func processRow(chain []CsvRowProcessorFunc, row []string, columnNames []string) [][]string {
+	rows := [][]string{row}
+	for _, processor := range chain {
+		var processed [][]string
+		for _, row := range rows {
+			processed = append(processed, processor(row, columnNames)...)
+		}
+		rows = processed
+	}
+	return rows
+}
+
 // String returns the CSV as a string in an fmt package friendly way
 func (c Converter) String() string {
 	csv, err := c.WriteString()
@@ -78,112 +193,536 @@ func (c Converter) WriteString() (string, error) {
 
 // WriteFile writes the CSV to the filename specified, return an error if problem
 func (c Converter) WriteFile(csvFileName string) error {
+	var stats *writeStats
+	if c.WriteChecksum || c.WriteManifest || c.Schema != SchemaNone {
+		stats = &writeStats{}
+	}
+	return c.writeFile(csvFileName, false, stats)
+}
+
+// writeFile does the work of WriteFile. When atomic is set it writes to
+// a temporary file renamed into place once complete. Given stats it
+// collects the row count, size and SHA-256 of the file as it's written
+// and then writes any sidecar files.
+func (c Converter) writeFile(csvFileName string, atomic bool, stats *writeStats) error {
+	if atomic {
+		staged, err := c.stageFile(csvFileName, stats)
+		if err != nil {
+			return err
+		}
+		return c.commitFile(staged, csvFileName, stats)
+	}
+
 	f, err := os.Create(csvFileName)
 	if err != nil {
 		return err
 	}
+	if err = c.writeTo(f, stats); err != nil {
+		return err
+	}
+	if stats == nil {
+		return nil
+	}
+	return c.writeFileSidecars(csvFileName, stats)
+}
 
-	err = c.Write(f)
+// stageFile writes the CSV to a temporary file next to csvFileName,
+// returning its name for commitFile.
+func (c Converter) stageFile(csvFileName string, stats *writeStats) (string, error) {
+	f, err := createStaged(csvFileName)
 	if err != nil {
-		f.Close() // close, but only return/handle the write error
+		return "", err
+	}
+	if err = c.writeTo(f, stats); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createStaged creates a temporary file next to fileName to be renamed
+// over it. Unlike os.CreateTemp it has the permissions os.Create gives,
+// so the renamed file is readable just as one written in place would be.
+func createStaged(fileName string) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-")
+	for {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// commitFile renames a file from stageFile into place and writes any
+// sidecar files.
+func (c Converter) commitFile(staged, csvFileName string, stats *writeStats) error {
+	if err := os.Rename(staged, csvFileName); err != nil {
+		os.Remove(staged)
 		return err
 	}
+	if stats == nil {
+		return nil
+	}
+	return c.writeFileSidecars(csvFileName, stats)
+}
+
+// writeTo writes the CSV to f and closes it.
+func (c Converter) writeTo(f *os.File, stats *writeStats) error {
+	// hash while writing rather than reading the file back
+	var writer io.Writer = f
+	if stats != nil {
+		stats.started = time.Now()
+		stats.sum = sha256.New()
+		counter := &countingWriter{n: &stats.bytes}
+		writer = io.MultiWriter(f, stats.sum, counter)
+		c.stats = stats
+	}
 
+	if err := c.Write(writer); err != nil {
+		f.Close() // close, but only return/handle the write error
+		return err
+	}
 	return f.Close()
 }
 
 // Write writes the CSV to the Writer provided
 func (c Converter) Write(writer io.Writer) error {
+	if c.Encryption != nil {
+		encrypted, err := NewEncryptWriter(writer, *c.Encryption)
+		if err != nil {
+			return err
+		}
+		c.Encryption = nil
+		c.encryptSortRuns = true
+		if err = c.Write(encrypted); err != nil {
+			// leave the last chunk unsealed so the partial output won't decrypt
+			return err
+		}
+		return encrypted.Close()
+	}
+
 	rows := c.rows
-	csvWriter := csv.NewWriter(writer)
+
+	if c.ExcelSafe {
+		if _, err := io.WriteString(writer, byteOrderMark(c.Encoding)); err != nil {
+			return err
+		}
+	}
+
+	encodedWriter, err := newEncodingWriter(writer, c.Encoding, c.Unrepresentable)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(encodedWriter)
 	if c.Delimiter != '\x00' {
 		csvWriter.Comma = c.Delimiter
 	}
+	csvWriter.UseCRLF = c.UseCRLF
 
 	columnNames, err := rows.Columns()
 	if err != nil {
 		return err
 	}
+	columnNames, err = c.resolveDuplicates(columnNames)
+	if err != nil {
+		return err
+	}
+
+	var kinds []columnKind
+	if c.BinaryEncoding != BinaryRaw {
+		kinds = columnKinds(rows)
+		if err = c.checkBinaryColumns(kinds, columnNames); err != nil {
+			return err
+		}
+	}
+
+	computed, err := c.compileComputed(rows, columnNames)
+	if err != nil {
+		return err
+	}
+	filter, err := c.compileFilter(rows, columnNames)
+	if err != nil {
+		return err
+	}
+	scanner := newRowScanner(c, rows, columnNames, kinds, computed, filter)
+
+	allColumnNames := append(append([]string(nil), columnNames...), c.computedColumnNames()...)
+	shape, err := c.newShaper(rows, allColumnNames)
+	if err != nil {
+		return err
+	}
+
+	// read ahead far enough to discover the keys of any FlattenJSON
+	// columns, as they decide the headers
+	var sample [][]string
+	if shape.needsSample() {
+		for len(sample) < shape.sampleSize() && rows.Next() {
+			row, err := scanner.scan()
+			if err != nil {
+				return err
+			}
+			if row != nil {
+				sample = append(sample, append([]string(nil), row...))
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if err = shape.discoverKeys(sample); err != nil {
+			return err
+		}
+	}
+	selection, err := c.selectColumns(shape.outputColumnNames())
+	if err != nil {
+		return err
+	}
+	selection, policyRules, err := c.applyPolicy(selection)
+	if err != nil {
+		return err
+	}
+	outputColumnNames := selection.names
+	chain := c.processorChain()
+
+	masker, err := c.newMasker(outputColumnNames, policyRules)
+	if err != nil {
+		return err
+	}
+
+	// use Headers if set, otherwise default to
+	// query Columns (after any renaming)
+	headers := selection.headers
+	if len(c.Headers) > 0 {
+		headers = c.Headers
+	}
+	if c.StrictWidth && len(chain) == 0 && len(headers) != len(outputColumnNames) {
+		return fmt.Errorf("%d headers given for %d columns", len(headers), len(outputColumnNames))
+	}
+
+	var fields []schemaField
+	if c.stats != nil || c.HeaderTypes != HeaderTypesNone {
+		fields = c.schemaFields(rows, columnNames, outputColumnNames, headers, masker)
+	}
+	if c.stats != nil {
+		c.stats.columns = headers
+		c.stats.fields = fields
+	}
+
+	if c.WriteComments {
+		if err = c.checkCommentChar(); err != nil {
+			return err
+		}
+		if err = c.writeComments(encodedWriter); err != nil {
+			return err
+		}
+	}
 
 	if c.WriteHeaders {
-		// use Headers if set, otherwise default to
-		// query Columns
-		var headers []string
-		if len(c.Headers) > 0 {
-			headers = c.Headers
-		} else {
-			headers = columnNames
+		for _, headerRow := range c.headerRows(headers, fields) {
+			if c.ExcelSafe {
+				headerRow = c.excelSafeRow(headerRow, nil)
+			}
+			err = c.writeRecord(csvWriter, encodedWriter, headerRow)
+			if err != nil {
+				return fmt.Errorf("failed to write headers: %w", err)
+			}
 		}
-		err = csvWriter.Write(headers)
+	}
+
+	pipeline := &rowPipeline{
+		c:           c,
+		shape:       shape,
+		selection:   selection,
+		masker:      masker,
+		chain:       chain,
+		columnNames: outputColumnNames,
+		single:      make([][]string, 1),
+	}
+	rowNumber := 0
+	writeRow := func(row []string) error {
+		rowNumber++
+		if c.StrictWidth && len(row) != len(headers) {
+			return fmt.Errorf("row %d has %d columns but there are %d headers", rowNumber, len(row), len(headers))
+		}
+		err := c.writeRecord(csvWriter, encodedWriter, row)
 		if err != nil {
-			return fmt.Errorf("failed to write headers: %w", err)
+			return fmt.Errorf("failed to write data row to csv %w", err)
 		}
+		return nil
 	}
 
-	count := len(columnNames)
-	values := make([]interface{}, count)
-	valuePtrs := make([]interface{}, count)
+	// with Sort, rows are gathered in the sorter and written once all are read
+	emitRow := writeRow
+	var sorter *externalSorter
+	if len(c.Sort) > 0 {
+		unformatted := c
+		unformatted.FloatFormat = "" // to still sort formatted floats as numbers
+		sortFields := unformatted.schemaFields(rows, columnNames, outputColumnNames, headers, masker)
+		if sorter, err = c.newRowSorter(sortFields, outputColumnNames); err != nil {
+			return err
+		}
+		if c.encryptSortRuns {
+			// the sorted runs mustn't leave the process in plaintext either
+			if err = sorter.encryptRuns(); err != nil {
+				return err
+			}
+		}
+		defer sorter.remove()
+		emitRow = sorter.add
+	}
 
-	for rows.Next() {
-		row := make([]string, count)
+	for _, row := range sample {
+		if err = pipeline.run(row, emitRow); err != nil {
+			return err
+		}
+	}
 
-		for i, _ := range columnNames {
-			valuePtrs[i] = &values[i]
+	if c.Concurrency > 1 {
+		err = c.writeConcurrently(scanner, pipeline, emitRow)
+	} else {
+		err = writeSequentially(scanner, pipeline, emitRow)
+	}
+	if err == nil && sorter != nil {
+		err = writeSorted(sorter, writeRow)
+	}
+	if c.stats != nil {
+		c.stats.rows = int64(rowNumber)
+	}
+
+	csvWriter.Flush()
+	if err == nil {
+		err = csvWriter.Error()
+	}
+
+	if closer, ok := encodedWriter.(*encodingWriter); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
 		}
+	}
+
+	return err
+}
 
-		if err = rows.Scan(valuePtrs...); err != nil {
+func writeSequentially(scanner *rowScanner, pipeline *rowPipeline, writeRow func([]string) error) error {
+	for scanner.rows.Next() {
+		row, err := scanner.scan()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			continue
+		}
+		if err = pipeline.run(row, writeRow); err != nil {
 			return err
 		}
+	}
+	return scanner.rows.Err()
+}
 
-		for i, _ := range columnNames {
-			var value interface{}
-			rawValue := values[i]
+// rowPipeline turns a scanned row into the finished rows to write: JSON
+// and array shaping, column selection, masking, row processors and
+// ExcelSafe. Rows it emits are only valid until emit returns.
+type rowPipeline struct {
+	c           Converter
+	shape       *shaper
+	selection   *columnSelection
+	masker      *masker
+	chain       []CsvRowProcessorFunc
+	columnNames []string
+	single      [][]string
+}
 
-			byteArray, ok := rawValue.([]byte)
-			if ok {
-				value = string(byteArray)
-			} else {
-				value = rawValue
+func (p *rowPipeline) run(scanned []string, emit func(row []string) error) error {
+	shaped, err := p.shape.apply(scanned)
+	if err != nil {
+		return err
+	}
+	for _, shapedRow := range shaped {
+		selected := p.masker.apply(p.selection.apply(shapedRow))
+		processed := p.single
+		processed[0] = selected
+		if len(p.chain) > 0 {
+			processed = processRow(p.chain, selected, p.columnNames)
+		}
+		for _, row := range processed {
+			if p.c.ExcelSafe {
+				row = p.c.excelSafeRow(row, p.columnNames)
 			}
-
-			float64Value, ok := value.(float64)
-			if ok && c.FloatFormat != "" {
-				value = fmt.Sprintf(c.FloatFormat, float64Value)
-			} else {
-				float32Value, ok := value.(float32)
-				if ok && c.FloatFormat != "" {
-					value = fmt.Sprintf(c.FloatFormat, float32Value)
-				}
+			if err = emit(row); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
 
-			timeValue, ok := value.(time.Time)
-			if ok && c.TimeFormat != "" {
-				value = timeValue.Format(c.TimeFormat)
-			}
+// rowScanner reads rows and formats them as strings. It holds what is
+// worked out once per Write and scratch space reused between rows.
+type rowScanner struct {
+	c           Converter
+	rows        *sql.Rows
+	columnNames []string
+	kinds       []columnKind
+	computed    []expr
+	filter      expr
+	values      []interface{}
+	valuePtrs   []interface{}
+	raw         []sql.RawBytes // scanned into instead of values where rawSafe
+	rawSafe     []bool
+	row         []string
+	buf         []byte
+}
 
-			if value == nil {
-				row[i] = ""
-			} else {
-				row[i] = fmt.Sprintf("%v", value)
-			}
+func newRowScanner(c Converter, rows *sql.Rows, columnNames []string, kinds []columnKind, computed []expr, filter expr) *rowScanner {
+	s := &rowScanner{
+		c:           c,
+		rows:        rows,
+		columnNames: columnNames,
+		kinds:       kinds,
+		computed:    computed,
+		filter:      filter,
+		values:      make([]interface{}, len(columnNames)),
+		valuePtrs:   make([]interface{}, len(columnNames)),
+		raw:         make([]sql.RawBytes, len(columnNames)),
+		rawSafe:     rawSafeColumns(c, rows, len(columnNames), computed, filter),
+		row:         make([]string, len(columnNames), len(columnNames)+len(computed)),
+	}
+	for i := range s.values {
+		if s.rawSafe[i] {
+			s.valuePtrs[i] = &s.raw[i]
+		} else {
+			s.valuePtrs[i] = &s.values[i]
+		}
+	}
+	return s
+}
+
+// rawSafeColumns picks the columns that can be scanned into sql.RawBytes,
+// saving the driver's copy. That's text columns, as long as nothing needs
+// the typed values: no computed columns, Filter or onScan, and no UTF-8
+// checks.
+func rawSafeColumns(c Converter, rows *sql.Rows, n int, computed []expr, filter expr) []bool {
+	safe := make([]bool, n)
+	if len(computed) > 0 || filter != nil || c.onScan != nil || c.InvalidUTF8 != InvalidUTF8Pass {
+		return safe
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return safe
+	}
+	for i, columnType := range columnTypes {
+		if i < n && kindOf(columnType) == textColumn && exprKindOf(columnType) == kindString {
+			safe[i] = true
+		}
+	}
+	return safe
+}
+
+// scan scans the current row and formats each column as a string,
+// followed by any computed columns. It returns a nil row if the Filter
+// doesn't match. The row is reused, so it is only valid until the next
+// call.
+func (s *rowScanner) scan() ([]string, error) {
+	if err := s.rows.Scan(s.valuePtrs...); err != nil {
+		return nil, err
+	}
+	if s.c.onScan != nil {
+		if keep, err := s.c.onScan(s.values); !keep || err != nil {
+			return nil, err
 		}
+	}
+	return s.format()
+}
+
+// format formats the values last scanned, as scan does.
+func (s *rowScanner) format() ([]string, error) {
+	c := s.c
 
-		writeRow := true
-		if c.rowPreProcessor != nil {
-			writeRow, row = c.rowPreProcessor(row, columnNames)
+	if ok, err := matches(s.filter, s.values); !ok || err != nil {
+		return nil, err
+	}
+
+	row := s.row[:len(s.columnNames)]
+
+	for i, rawValue := range s.values {
+		if s.rawSafe[i] {
+			row[i] = string(s.raw[i])
+			continue
 		}
-		if writeRow {
-			err = csvWriter.Write(row)
+
+		byteArray, ok := rawValue.([]byte)
+		if ok && s.kinds != nil && s.kinds[i] != textColumn {
+			row[i] = c.formatBinary(byteArray, s.kinds[i])
+			continue
+		} else if ok {
+			value, err := checkUTF8(string(byteArray), s.columnNames[i], c.InvalidUTF8)
 			if err != nil {
-				return fmt.Errorf("failed to write data row to csv %w", err)
+				return nil, err
 			}
+			row[i] = value
+			continue
 		}
+
+		s.buf = c.appendValue(s.buf[:0], rawValue)
+		row[i] = string(s.buf)
 	}
-	err = rows.Err()
 
-	csvWriter.Flush()
+	for i, e := range s.computed {
+		value, err := e.eval(s.values)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %q: %w", c.ComputedColumns[i].Name, err)
+		}
+		row = append(row, c.formatValue(value))
+	}
 
-	return err
+	s.row = row
+	return row, nil
+}
+
+// formatValue turns a single value into the string written to the CSV.
+func (c Converter) formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return string(c.appendValue(nil, value))
+}
+
+// appendValue appends value as written to the CSV to buf. The common
+// types are handled without going through fmt; everything else is
+// formatted with %v.
+func (c Converter) appendValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return buf
+	case string:
+		return append(buf, v...)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case float64:
+		if c.FloatFormat != "" {
+			return fmt.Appendf(buf, c.FloatFormat, v)
+		}
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case float32:
+		if c.FloatFormat != "" {
+			return fmt.Appendf(buf, c.FloatFormat, v)
+		}
+		return strconv.AppendFloat(buf, float64(v), 'g', -1, 32)
+	case time.Time:
+		if c.TimeFormat != "" {
+			return v.AppendFormat(buf, c.TimeFormat)
+		}
+		return append(buf, v.String()...)
+	}
+	return fmt.Appendf(buf, "%v", value)
 }
 
 // New will return a Converter which will write your CSV however you like
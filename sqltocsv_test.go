@@ -105,6 +105,52 @@ func TestSetRowPreProcessorOmittingRows(t *testing.T) {
 	assertCsvMatch(t, expected, actual)
 }
 
+func TestAddRowProcessorExpandingRows(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		return [][]string{row, {"subtotal", row[1], ""}}
+	})
+
+	expected := "name,age,bdate\nAlice,1,1973-11-29 21:33:09 +0000 UTC\nsubtotal,1,\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestAddRowProcessorOmittingRows(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		return nil
+	})
+
+	expected := "name,age,bdate\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
+func TestRowProcessorChainOrder(t *testing.T) {
+	converter := getConverter(t)
+
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		return [][]string{{row[0], "a"}, {row[0], "b"}}
+	})
+	converter.AddRowProcessor(func(row []string, columnNames []string) [][]string {
+		return [][]string{{row[0], row[1] + "1"}, {row[0], row[1] + "2"}}
+	})
+	// SetRowPreProcessor always goes first, whenever it is set
+	converter.SetRowPreProcessor(func(row []string, columnNames []string) (bool, []string) {
+		return true, []string{"Bob", row[1], row[2]}
+	})
+
+	expected := "name,age,bdate\nBob,a1\nBob,a2\nBob,b1\nBob,b2\n"
+	actual := converter.String()
+
+	assertCsvMatch(t, expected, actual)
+}
+
 func TestSetTimeFormat(t *testing.T) {
 	converter := getConverter(t)
 
@@ -201,3 +247,56 @@ func assertCsvMatch(t *testing.T, expected string, actual string) {
 		t.Errorf("Expected CSV:\n\n%v\n Got CSV:\n\n%v\n", expected, actual)
 	}
 }
+
+func BenchmarkWrite(b *testing.B) {
+	db := setupEventsDatabase(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows, err := db.Query("SELECT|events|name,count,score,at,note|")
+		if err != nil {
+			b.Fatalf("error querying: %v", err)
+		}
+		if err = sqltocsv.New(rows).Write(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteTimeFormat(b *testing.B) {
+	db := setupEventsDatabase(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rows, err := db.Query("SELECT|events|name,count,score,at,note|")
+		if err != nil {
+			b.Fatalf("error querying: %v", err)
+		}
+		converter := sqltocsv.New(rows)
+		converter.TimeFormat = time.RFC3339
+		if err = converter.Write(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func setupEventsDatabase(tb testing.TB, n int) *sql.DB {
+	db, err := sql.Open("test", "foo")
+	if err != nil {
+		tb.Fatalf("Error opening testdb %v", err)
+	}
+	exec(tb, db, "WIPE")
+	exec(tb, db, "CREATE|events|name=string,count=int64,score=float64,at=datetime,note=nullstring")
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		var note interface{}
+		if i%3 == 0 {
+			note = "a note with, a comma"
+		}
+		exec(tb, db, "INSERT|events|name=?,count=?,score=?,at=?,note=?",
+			"event", int64(i), float64(i)/7, at.Add(time.Duration(i)*time.Second), note)
+	}
+	return db
+}